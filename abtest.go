@@ -0,0 +1,212 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// Payload key holding the variant id of an A/B test push
+const VariantPayloadKey = "pushbots_variant"
+
+// ABVariant is one copy of the notification in an A/B test.
+// Empty fields use those of the notification being tested.
+type ABVariant struct {
+	Id      string
+	Weight  int // Relative share of the recipients
+	Msg     string
+	Sound   string
+	Badge   string
+	Payload map[string]interface{} // Merged into the payload of the notification
+}
+
+// ABTest splits recipients between weighted variants. A recipient is
+// bucketed by a hash of the test name and its alias, or its token when it has
+// no alias, so it always gets the same variant of a test and every device of
+// a user gets the same one.
+type ABTest struct {
+	Name     string
+	Variants []ABVariant
+	// Tag every recipient with VariantTag for later targeting. The variant is
+	// still pushed to the tokens of this send only, devices tagged by earlier
+	// sends of the test aren't reached again.
+	TagRecipients bool
+}
+
+// ABReport counts the recipients of every variant by variant id
+type ABReport struct {
+	Test       string         `json:"test"`
+	Recipients map[string]int `json:"recipients"`
+	Failed     map[string]int `json:"failed"`
+}
+
+// Validate checks the test has variants with unique ids and a positive total weight
+func (test ABTest) Validate() error {
+	if test.Name == "" {
+		return newValidationError("name", test.Name, "A/B test name needs to be set")
+	}
+
+	total := 0
+	var ids []string
+
+	for _, variant := range test.Variants {
+		if variant.Id == "" || containsString(ids, variant.Id) {
+			return newValidationError("id", variant.Id, "Variant ids need to be set and unique")
+		}
+
+		if variant.Weight < 0 {
+			return newValidationError("weight", variant.Id, "Variant weights can't be negative")
+		}
+
+		ids = append(ids, variant.Id)
+		total += variant.Weight
+	}
+
+	if total <= 0 {
+		return newValidationError("weight", test.Name, "A/B test needs variants with a positive total weight")
+	}
+
+	return nil
+}
+
+// Assign returns the variant of a recipient key, an alias or a token.
+// A test that isn't valid assigns every key to its first variant, or the
+// zero ABVariant when it has none.
+func (test ABTest) Assign(key string) ABVariant {
+	total := 0
+
+	for _, variant := range test.Variants {
+		total += variant.Weight
+	}
+
+	if len(test.Variants) == 0 {
+		return ABVariant{}
+	}
+
+	if total <= 0 {
+		return test.Variants[0]
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(test.Name + "/" + key))
+	bucket := int(hash.Sum64() % uint64(total))
+
+	for _, variant := range test.Variants {
+		if bucket < variant.Weight {
+			return variant
+		}
+
+		bucket -= variant.Weight
+	}
+
+	return test.Variants[len(test.Variants)-1]
+}
+
+// VariantTag is the tag given to recipients of a variant with TagRecipients
+func (test ABTest) VariantTag(variantId string) string {
+	return "ab-" + test.Name + "-" + variantId
+}
+
+// Send an A/B test of notification to the audience. Recipients are the
+// devices in PushBots.Devices matching the audience, every push carries its
+// variant id under VariantPayloadKey. Failed devices are reported as DeliveryErrors.
+func (pushbots *PushBots) SendABTest(test ABTest, notification Notification, audience Audience) (ABReport, error) {
+	report := ABReport{Test: test.Name, Recipients: make(map[string]int), Failed: make(map[string]int)}
+
+	if err := test.Validate(); err != nil {
+		return report, err
+	}
+
+	if pushbots.Devices == nil {
+		return report, ErrNoDeviceStore
+	}
+
+	devices, err := pushbots.Devices.List()
+
+	if err != nil {
+		return report, err
+	}
+
+	variants := make(map[string]ABVariant)
+	recipients := make(map[string][]Device)
+
+	for _, device := range devices {
+		if !audience.matches(notification.Platform, device) {
+			continue
+		}
+
+		key := device.Alias
+
+		if key == "" {
+			key = device.Token
+		}
+
+		variant := test.Assign(key)
+		variants[variant.Id] = variant
+		recipients[variant.Id] = append(recipients[variant.Id], device)
+		report.Recipients[variant.Id]++
+	}
+
+	ids := make([]string, 0, len(variants))
+
+	for id := range variants {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	deliveryErrors := make(DeliveryErrors)
+
+	for _, id := range ids {
+		variant := variants[id]
+		marked := overrideNotification(notification, variant.Msg, variant.Sound, variant.Badge, variant.Payload)
+		marked = overrideNotification(marked, "", "", "", map[string]interface{}{VariantPayloadKey: id})
+
+		devices := recipients[id]
+
+		if test.TagRecipients {
+			devices = pushbots.tagVariant(test.VariantTag(id), devices, deliveryErrors)
+		}
+
+		for _, device := range devices {
+			perDevice := marked
+			perDevice.Platform = device.Platform
+
+			if err := pushbots.SendNotificationToDevice(device.Token, perDevice); err != nil {
+				deliveryErrors[device.Token] = err
+			}
+		}
+
+		for _, device := range recipients[id] {
+			if deliveryErrors[device.Token] != nil {
+				report.Failed[id]++
+			}
+		}
+	}
+
+	if len(deliveryErrors) > 0 {
+		return report, deliveryErrors
+	}
+
+	return report, nil
+}
+
+// Tags the recipients of a variant, returning those that are tagged
+func (pushbots *PushBots) tagVariant(tag string, devices []Device, deliveryErrors DeliveryErrors) []Device {
+	var tagged []Device
+
+	for _, device := range devices {
+		if device.HasTag(tag) {
+			tagged = append(tagged, device)
+		} else if err := pushbots.TagDevice(device.Token, device.Platform, "", tag); err != nil {
+			deliveryErrors[device.Token] = err
+		} else {
+			tagged = append(tagged, device)
+		}
+	}
+
+	return tagged
+}
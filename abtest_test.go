@@ -0,0 +1,159 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestABTestAssign(t *testing.T) {
+	test := ABTest{Name: "copy", Variants: []ABVariant{{Id: "a", Weight: 3}, {Id: "b", Weight: 1}}}
+
+	if err := test.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		variant := test.Assign(key)
+
+		if test.Assign(key).Id != variant.Id {
+			t.Fatal("Assignment should be deterministic")
+		}
+
+		counts[variant.Id]++
+	}
+
+	if counts["a"] < 2800 || counts["a"] > 3200 {
+		t.Fatal("Weights not respected", counts)
+	}
+
+	invalid := []ABTest{
+		{Name: "", Variants: test.Variants},
+		{Name: "x"},
+		{Name: "x", Variants: []ABVariant{{Id: "a", Weight: 1}, {Id: "a", Weight: 1}}},
+		{Name: "x", Variants: []ABVariant{{Id: "a", Weight: 0}}},
+		{Name: "x", Variants: []ABVariant{{Id: "a", Weight: -1}, {Id: "b", Weight: 2}}},
+	}
+
+	for _, test := range invalid {
+		if test.Validate() == nil {
+			t.Fatal("Expected test to be invalid", test)
+		}
+
+		// An invalid test must not panic
+		test.Assign("user-1")
+	}
+}
+
+func newABPushBots(serverURL string) PushBots {
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(serverURL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+
+	for i := 0; i < 20; i++ {
+		pushBots.Devices.Save(Device{Token: fmt.Sprintf("device-%d", i), Platform: PlatformIos, Tags: []string{tag1}})
+	}
+
+	// Both devices of a user get the same variant
+	pushBots.Devices.Save(Device{Token: "phone", Platform: PlatformIos, Alias: "user-1", Tags: []string{tag1}})
+	pushBots.Devices.Save(Device{Token: "tablet", Platform: PlatformAndroid, Alias: "user-1", Tags: []string{tag1}})
+	pushBots.Devices.Save(Device{Token: "other", Platform: PlatformIos})
+
+	return pushBots
+}
+
+func TestSendABTestWithPayload(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	pushBots := newABPushBots(server.URL)
+	test := ABTest{Name: "copy", Variants: []ABVariant{{Id: "a", Weight: 1, Msg: "Copy A"}, {Id: "b", Weight: 1, Msg: "Copy B"}}}
+
+	report, err := pushBots.SendABTest(test, Notification{Platform: PlatformAll, Msg: msg, Sound: sound}, Audience{Tags: []string{tag1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.received()
+
+	if report.Recipients["a"]+report.Recipients["b"] != 22 || len(requests) != 22 {
+		t.Fatal("Expected one push per matching device", report, len(requests))
+	}
+
+	userVariant := ""
+
+	for _, request := range requests {
+		variant := request.Payload[VariantPayloadKey]
+
+		if request.Msg != "Copy "+map[interface{}]string{"a": "A", "b": "B"}[variant] {
+			t.Fatal("Message doesn't match the variant", request.Msg, variant)
+		}
+
+		if request.Token == "phone" || request.Token == "tablet" {
+			if userVariant != "" && userVariant != variant {
+				t.Fatal("Devices of a user got different variants")
+			}
+
+			userVariant = variant.(string)
+		}
+	}
+}
+
+func TestSendABTestWithTags(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	pushBots := newABPushBots(server.URL)
+	test := ABTest{Name: "copy", TagRecipients: true, Variants: []ABVariant{{Id: "a", Weight: 1}, {Id: "b", Weight: 1}}}
+
+	// Tagged by an earlier send but outside the audience this time
+	pushBots.Devices.Save(Device{Token: "stale", Platform: PlatformIos, Tags: []string{test.VariantTag("a"), test.VariantTag("b")}})
+
+	report, err := pushBots.SendABTest(test, Notification{Platform: PlatformIos, Msg: msg, Sound: sound}, Audience{Tags: []string{tag1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.received()
+
+	// 21 iOS devices tagged, then pushed one by one
+	if len(requests) != 42 {
+		t.Fatal("Expected a tag call and a push per recipient", len(requests))
+	}
+
+	var pushes []recordedRequest
+
+	for _, request := range requests {
+		if request.Msg != "" {
+			pushes = append(pushes, request)
+		}
+	}
+
+	if len(pushes) != 21 {
+		t.Fatal("Expected one push per recipient", len(pushes))
+	}
+
+	for _, push := range pushes {
+		if push.Token == "" || push.Token == "stale" || len(push.Tags) != 0 {
+			t.Fatal("Pushes should only target the tokens of this send", push.Token, push.Tags)
+		}
+	}
+
+	device, _ := pushBots.Devices.Get("phone")
+
+	if !device.HasTag(test.VariantTag(test.Assign("user-1").Id)) {
+		t.Fatal("Recipient should be tagged with its variant", device.Tags)
+	}
+
+	if report.Recipients["a"]+report.Recipients["b"] != 21 {
+		t.Fatal("Wrong recipient counts", report)
+	}
+}
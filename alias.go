@@ -0,0 +1,184 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+// Alias based operations. An alias is typically the id of a user in your own
+// system, set on each of their devices with SetAlias, so a backend can
+// address users without keeping track of device tokens.
+
+// Set the alias of a device
+func (pushbots *PushBots) SetAlias(token, platform, alias string) error {
+	if err := pushbots.checkArgs(token, platform); err != nil {
+		return err
+	}
+
+	if alias == "" {
+		return newValidationError("alias", alias, "No alias specified")
+	}
+
+	args := apiRequest{
+		Token:    token,
+		Platform: platform,
+		Alias:    alias,
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("alias", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.Alias = alias
+	})
+
+	return nil
+}
+
+// Remove the alias from a device
+func (pushbots *PushBots) RemoveAlias(token, platform, alias string) error {
+	if err := pushbots.checkArgs(token, platform); err != nil {
+		return err
+	}
+
+	if alias == "" {
+		return newValidationError("alias", alias, "No alias specified")
+	}
+
+	args := apiRequest{
+		Token:    token,
+		Platform: platform,
+		Alias:    alias,
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("removealias", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, "", func(device *Device) {
+		device.Alias = ""
+	})
+
+	return nil
+}
+
+// Send a push to every device with the alias
+func (pushbots *PushBots) SendPushToAlias(platform, alias, msg, sound, badge string, payload map[string]interface{}) error {
+	if err := checkForAliasErrors(alias, platform); err != nil {
+		return err
+	}
+
+	return pushbots.Batch(platform, msg, sound, badge, nil, nil, nil, nil, alias, "", payload)
+}
+
+// Set the badgecount for every device with the alias
+func (pushbots *PushBots) BadgeAlias(alias, platform string, badgeCount int) error {
+	if err := checkForAliasErrors(alias, platform); err != nil {
+		return err
+	}
+
+	args := apiRequest{
+		Alias:      alias,
+		Platform:   platform,
+		BadgeCount: &badgeCount,
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("badge", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror("", platform, alias, func(device *Device) {
+		device.Badge = badgeCount
+	})
+
+	return nil
+}
+
+// Add geo information to every device with the alias
+func (pushbots *PushBots) GeoAlias(alias, platform string, coordinates Coordinates) error {
+	if err := checkForAliasErrors(alias, platform); err != nil {
+		return err
+	}
+
+	if err := coordinates.Validate(); err != nil {
+		return err
+	}
+
+	args := apiRequest{
+		Alias:    alias,
+		Platform: platform,
+		Lat:      formatCoordinate(coordinates.Lat),
+		Lng:      formatCoordinate(coordinates.Lng),
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("geos", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror("", platform, alias, func(device *Device) {
+		device.Location = &coordinates
+	})
+
+	return nil
+}
+
+// Unregister every device with the alias
+func (pushbots *PushBots) UnregisterAlias(alias, platform string) error {
+	if err := checkForAliasErrors(alias, platform); err != nil {
+		return err
+	}
+
+	args := apiRequest{
+		Alias:    alias,
+		Platform: platform,
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("unregisterdevice", args)); err != nil {
+		return err
+	}
+
+	if pushbots.Devices == nil {
+		return nil
+	}
+
+	devices, err := pushbots.Devices.ByAlias(alias)
+
+	if err != nil {
+		pushbots.mirrorFailed("", alias, err)
+		return nil
+	}
+
+	for _, device := range devices {
+		if device.Platform == platform {
+			pushbots.forget(device.Token)
+		}
+	}
+
+	return nil
+}
+
+// Record analytics for the devices with the alias
+func (pushbots *PushBots) RecordAnalyticsAlias(alias, platform, stats string) error {
+	if err := checkForAliasErrors(alias, platform); err != nil {
+		return err
+	}
+
+	args := apiRequest{
+		Alias:    alias,
+		Platform: platform,
+		Stats:    stats,
+	}
+
+	return checkAndReturn(pushbots.sendToEndpoint("recordanalytics", args))
+}
+
+// Checks for errors when an alias is required
+func checkForAliasErrors(alias, platform string) error {
+	if alias == "" {
+		return newValidationError("alias", alias, "Alias needs to be set")
+	} else if platform != PlatformIos && platform != PlatformAndroid {
+		return newValidationError("platform", platform, "Platform must be either PlatformIos or PlatformAndroid")
+	}
+
+	return nil
+}
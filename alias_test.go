@@ -0,0 +1,112 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAliasOperations(t *testing.T) {
+	var lastPath string
+	var lastBody map[string]interface{}
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath = r.Method + " " + r.URL.Path
+		lastBody = make(map[string]interface{})
+
+		if err := json.NewDecoder(r.Body).Decode(&lastBody); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+
+	cases := []struct {
+		call     func() error
+		path     string
+		expected map[string]interface{}
+	}{
+		{
+			func() error { return pushBots.SetAlias(token, PlatformIos, alias) },
+			"PUT /alias",
+			map[string]interface{}{"token": token, "platform": PlatformIos, "alias": alias},
+		},
+		{
+			func() error { return pushBots.BadgeAlias(alias, PlatformIos, 2) },
+			"PUT /badge",
+			map[string]interface{}{"alias": alias, "platform": PlatformIos, "setbadgecount": float64(2)},
+		},
+		{
+			func() error { return pushBots.GeoAlias(alias, PlatformIos, Coordinates{Lat: 1.5, Lng: -2}) },
+			"PUT /geo",
+			map[string]interface{}{"alias": alias, "platform": PlatformIos, "lat": "1.5", "lng": "-2"},
+		},
+		{
+			func() error { return pushBots.RecordAnalyticsAlias(alias, PlatformIos, "o") },
+			"PUT /stats",
+			map[string]interface{}{"alias": alias, "platform": PlatformIos, "stats": "o"},
+		},
+		{
+			func() error { return pushBots.RemoveAlias(token, PlatformIos, alias) },
+			"PUT /alias/del",
+			map[string]interface{}{"token": token, "platform": PlatformIos, "alias": alias},
+		},
+		{
+			func() error { return pushBots.UnregisterAlias(alias, PlatformIos) },
+			"PUT /deviceToken/del",
+			map[string]interface{}{"alias": alias, "platform": PlatformIos},
+		},
+	}
+
+	for _, c := range cases {
+		if err := c.call(); err != nil {
+			t.Fatal(err)
+		}
+
+		if lastPath != c.path {
+			t.Fatalf("Expected %s, got %s", c.path, lastPath)
+		}
+
+		if !reflect.DeepEqual(lastBody, c.expected) {
+			t.Fatalf("%s: expected body %v, got %v", c.path, c.expected, lastBody)
+		}
+
+		// The mirror follows the alias around
+		if c.path == "PUT /geo" {
+			device, err := pushBots.Devices.Get(token)
+
+			if err != nil || device.Alias != alias || device.Badge != 2 || device.Location.Lat != 1.5 {
+				t.Fatalf("Mirror not updated by alias calls %+v %v", device, err)
+			}
+		}
+	}
+
+	if device, _ := pushBots.Devices.Get(token); device.Alias != "" {
+		t.Fatal("RemoveAlias should clear the alias in the mirror")
+	}
+
+	if err := pushBots.SendPushToAlias(PlatformAndroid, alias, msg, sound, badge, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if lastPath != "POST /push/all" || lastBody["alias"] != alias || lastBody["msg"] != msg {
+		t.Fatal("Push to alias sent wrong request", lastPath, lastBody)
+	}
+
+	if err := pushBots.SendPushToAlias(PlatformIos, "", msg, sound, badge, nil); err == nil {
+		t.Fatal("Missing alias should be rejected")
+	}
+
+	if err := pushBots.SetAlias(token, PlatformIos, ""); err == nil {
+		t.Fatal("Empty alias should be rejected")
+	}
+}
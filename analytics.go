@@ -0,0 +1,168 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"sort"
+	"sync"
+)
+
+// AnalyticsEvent is a kind of event an app reports about a notification
+type AnalyticsEvent string
+
+const (
+	// The user opened the app from the notification. The value is the stat
+	// code PushBots records an open with, the only one it has.
+	AnalyticsOpened AnalyticsEvent = "o"
+	// PushBots has no stats for these, they are only counted by a Tracker
+	AnalyticsReceived  AnalyticsEvent = "received"  // The notification reached the device
+	AnalyticsDismissed AnalyticsEvent = "dismissed" // The user dismissed the notification without opening it
+)
+
+// Valid reports whether the event is one of the known kinds
+func (event AnalyticsEvent) Valid() bool {
+	return event == AnalyticsOpened || event == AnalyticsReceived || event == AnalyticsDismissed
+}
+
+// RecordedByPushBots reports whether PushBots has a stat for the event
+func (event AnalyticsEvent) RecordedByPushBots() bool {
+	return event == AnalyticsOpened
+}
+
+// Payload keys set by Track, the app should send them back when reporting an event
+const (
+	TrackingIdPayloadKey = "pushbots_tracking_id"
+	CampaignPayloadKey   = "pushbots_campaign"
+)
+
+// Record an analytics event for a device, only events RecordedByPushBots can be recorded
+func (pushbots *PushBots) RecordEvent(token, platform string, event AnalyticsEvent) error {
+	if !event.RecordedByPushBots() {
+		return newValidationError("event", string(event), "PushBots has no stat for the analytics event")
+	}
+
+	return pushbots.RecordAnalytics(token, platform, string(event))
+}
+
+// Track returns a copy of notification with a new tracking id and the
+// campaign in its payload, along with the tracking id
+func Track(notification Notification, campaign string) (Notification, string) {
+	trackingId := newJobId()
+	payload := make(map[string]interface{}, len(notification.Payload)+2)
+
+	for key, value := range notification.Payload {
+		payload[key] = value
+	}
+
+	payload[TrackingIdPayloadKey] = trackingId
+
+	if campaign != "" {
+		payload[CampaignPayloadKey] = campaign
+	}
+
+	notification.Payload = payload
+
+	return notification, trackingId
+}
+
+// Send a notification carrying a tracking id for campaign, see Track and SendNotification
+func (pushbots *PushBots) SendTracked(notification Notification, audience Audience, campaign string) (string, error) {
+	tracked, trackingId := Track(notification, campaign)
+
+	return trackingId, pushbots.SendNotification(tracked, audience)
+}
+
+// TrackingReport is what an app reports back about a tracked notification
+type TrackingReport struct {
+	Token      string         `json:"token"`
+	Platform   string         `json:"platform"`
+	Event      AnalyticsEvent `json:"event"`
+	TrackingId string         `json:"tracking_id,omitempty"`
+	Campaign   string         `json:"campaign,omitempty"`
+}
+
+// NewTrackingReport builds a report from the payload the app received
+func NewTrackingReport(token, platform string, event AnalyticsEvent, payload map[string]interface{}) TrackingReport {
+	report := TrackingReport{Token: token, Platform: platform, Event: event}
+	report.TrackingId, _ = payload[TrackingIdPayloadKey].(string)
+	report.Campaign, _ = payload[CampaignPayloadKey].(string)
+
+	return report
+}
+
+// Tracker is used by the backend the app reports to. Every report is recorded
+// with PushBots and counted per campaign. It is safe for concurrent use.
+type Tracker struct {
+	pushBots *PushBots
+	lock     sync.Mutex
+	counts   map[string]map[AnalyticsEvent]int
+	// Called after every recorded report, may be nil
+	OnReport func(report TrackingReport)
+}
+
+// Create a tracker recording stats through pushBots
+func NewTracker(pushBots *PushBots) *Tracker {
+	return &Tracker{pushBots: pushBots, counts: make(map[string]map[AnalyticsEvent]int)}
+}
+
+// Report records the stat of a report with PushBots, when it has one, and
+// counts it for its campaign. Reports without a campaign are counted under
+// the empty campaign.
+func (tracker *Tracker) Report(report TrackingReport) error {
+	if !report.Event.Valid() {
+		return newValidationError("event", string(report.Event), "Unknown analytics event")
+	}
+
+	if report.Event.RecordedByPushBots() {
+		if err := tracker.pushBots.RecordEvent(report.Token, report.Platform, report.Event); err != nil {
+			return err
+		}
+	}
+
+	tracker.lock.Lock()
+
+	if tracker.counts[report.Campaign] == nil {
+		tracker.counts[report.Campaign] = make(map[AnalyticsEvent]int)
+	}
+
+	tracker.counts[report.Campaign][report.Event]++
+	tracker.lock.Unlock()
+
+	if tracker.OnReport != nil {
+		tracker.OnReport(report)
+	}
+
+	return nil
+}
+
+// Counts returns how many events of each kind were reported for campaign
+func (tracker *Tracker) Counts(campaign string) map[AnalyticsEvent]int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	counts := make(map[AnalyticsEvent]int, len(tracker.counts[campaign]))
+
+	for event, count := range tracker.counts[campaign] {
+		counts[event] = count
+	}
+
+	return counts
+}
+
+// Campaigns returns every campaign with reports, sorted
+func (tracker *Tracker) Campaigns() []string {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	campaigns := make([]string, 0, len(tracker.counts))
+
+	for campaign := range tracker.counts {
+		campaigns = append(campaigns, campaign)
+	}
+
+	sort.Strings(campaigns)
+
+	return campaigns
+}
@@ -0,0 +1,92 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTrackedSendAndReport(t *testing.T) {
+	var lock sync.Mutex
+	var requests []apiRequest
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args apiRequest
+		json.NewDecoder(r.Body).Decode(&args)
+
+		lock.Lock()
+		requests = append(requests, args)
+		lock.Unlock()
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	original := Notification{Platform: PlatformIos, Msg: msg, Sound: sound, Payload: map[string]interface{}{"screen": "offers"}}
+	trackingId, err := pushBots.SendTracked(original, Audience{Token: token}, "spring-sale")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(original.Payload) != 1 {
+		t.Fatal("The original payload should not be modified", original.Payload)
+	}
+
+	payload := requests[0].Payload
+
+	if payload[TrackingIdPayloadKey] != trackingId || payload[CampaignPayloadKey] != "spring-sale" || payload["screen"] != "offers" {
+		t.Fatal("Tracking not embedded in the payload", payload)
+	}
+
+	// The app echoes the payload back when the notification is opened
+	tracker := NewTracker(&pushBots)
+	var reported []TrackingReport
+	tracker.OnReport = func(report TrackingReport) { reported = append(reported, report) }
+
+	report := NewTrackingReport(token, PlatformIos, AnalyticsOpened, payload)
+
+	if report.TrackingId != trackingId || report.Campaign != "spring-sale" {
+		t.Fatal("Wrong report from payload", report)
+	}
+
+	if err := tracker.Report(report); err != nil {
+		t.Fatal(err)
+	}
+
+	// PushBots has no stat for a dismissal, it is only counted
+	if err := tracker.Report(NewTrackingReport(token, PlatformIos, AnalyticsDismissed, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 || requests[1].Stats != "o" || requests[1].Token != token {
+		t.Fatal("Only the open should be recorded with PushBots", requests)
+	}
+
+	if err := pushBots.RecordEvent(token, PlatformIos, AnalyticsReceived); err == nil {
+		t.Fatal("RecordEvent should refuse events PushBots has no stat for")
+	}
+
+	if counts := tracker.Counts("spring-sale"); counts[AnalyticsOpened] != 1 || len(counts) != 1 {
+		t.Fatal("Wrong campaign counts", counts)
+	}
+
+	if campaigns := tracker.Campaigns(); len(campaigns) != 2 || campaigns[0] != "" || campaigns[1] != "spring-sale" {
+		t.Fatal("Wrong campaigns", campaigns)
+	}
+
+	if len(reported) != 2 {
+		t.Fatal("OnReport should be called for every report", reported)
+	}
+
+	if err := tracker.Report(TrackingReport{Token: token, Platform: PlatformIos, Event: "clicked"}); err == nil {
+		t.Fatal("Unknown events should be rejected")
+	}
+}
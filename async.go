@@ -0,0 +1,163 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors resolved into a PushFuture that never reached a worker
+var (
+	ErrQueueFull        = errors.New("Async push queue is full")
+	ErrDispatcherClosed = errors.New("Async dispatcher is shut down")
+)
+
+// PushResult is the outcome of an asynchronous push
+type PushResult struct {
+	Notification Notification
+	Audience     Audience
+	Err          error
+	Enqueued     time.Time
+	Started      time.Time // Zero if the push never reached a worker
+	Finished     time.Time
+}
+
+// PushFuture resolves to a PushResult once the push has been handled
+type PushFuture struct {
+	result PushResult
+	done   chan struct{}
+}
+
+func newPushFuture(notification Notification, audience Audience) *PushFuture {
+	return &PushFuture{
+		result: PushResult{Notification: notification, Audience: audience, Enqueued: time.Now()},
+		done:   make(chan struct{}),
+	}
+}
+
+func (future *PushFuture) resolve(err error) {
+	future.result.Err = err
+	future.result.Finished = time.Now()
+	close(future.done)
+}
+
+// Done is closed once the result is available
+func (future *PushFuture) Done() <-chan struct{} {
+	return future.done
+}
+
+// Result blocks until the push has been handled
+func (future *PushFuture) Result() PushResult {
+	<-future.done
+	return future.result
+}
+
+// Wait blocks until the push has been handled or ctx is done
+func (future *PushFuture) Wait(ctx context.Context) (PushResult, error) {
+	select {
+	case <-future.done:
+		return future.result, nil
+	case <-ctx.Done():
+		return PushResult{}, ctx.Err()
+	}
+}
+
+// AsyncDispatcher sends notifications from a bounded queue using a fixed
+// number of worker goroutines, so callers never wait on the PushBots API.
+type AsyncDispatcher struct {
+	pushBots *PushBots
+	queue    chan *PushFuture
+	workers  sync.WaitGroup
+
+	lock   sync.RWMutex // Guards closed and sends on queue
+	closed bool
+}
+
+// Create a dispatcher with room for queueSize waiting pushes and workers concurrent API calls
+func NewAsyncDispatcher(pushBots *PushBots, queueSize, workers int) *AsyncDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	dispatcher := &AsyncDispatcher{
+		pushBots: pushBots,
+		queue:    make(chan *PushFuture, queueSize),
+	}
+
+	dispatcher.workers.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go dispatcher.work()
+	}
+
+	return dispatcher
+}
+
+func (dispatcher *AsyncDispatcher) work() {
+	defer dispatcher.workers.Done()
+
+	for future := range dispatcher.queue {
+		future.result.Started = time.Now()
+		future.resolve(dispatcher.pushBots.SendNotification(future.result.Notification, future.result.Audience))
+	}
+}
+
+// SendAsync queues a push and returns immediately.
+// If the queue is full or the dispatcher is shut down the returned future is
+// already resolved with ErrQueueFull or ErrDispatcherClosed.
+func (dispatcher *AsyncDispatcher) SendAsync(notification Notification, audience Audience) *PushFuture {
+	future := newPushFuture(notification, audience)
+
+	dispatcher.lock.RLock()
+	defer dispatcher.lock.RUnlock()
+
+	if dispatcher.closed {
+		future.resolve(ErrDispatcherClosed)
+		return future
+	}
+
+	select {
+	case dispatcher.queue <- future:
+	default:
+		future.resolve(ErrQueueFull)
+	}
+
+	return future
+}
+
+// Shutdown stops accepting pushes and waits for queued and in-flight pushes
+// to finish. If ctx is done first its error is returned and the remaining
+// pushes keep draining in the background.
+func (dispatcher *AsyncDispatcher) Shutdown(ctx context.Context) error {
+	dispatcher.lock.Lock()
+
+	if !dispatcher.closed {
+		dispatcher.closed = true
+		close(dispatcher.queue)
+	}
+
+	dispatcher.lock.Unlock()
+
+	drained := make(chan struct{})
+
+	go func() {
+		dispatcher.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
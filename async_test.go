@@ -0,0 +1,103 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAsyncDispatcher(t *testing.T) {
+	var handled int32
+	arrived := make(chan struct{}, 4)
+	release := make(chan struct{})
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		atomic.AddInt32(&handled, 1)
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	dispatcher := NewAsyncDispatcher(&pushBots, 2, 1)
+	notification := Notification{Platform: PlatformIos, Msg: msg}
+	audience := Audience{Token: token}
+
+	futures := []*PushFuture{dispatcher.SendAsync(notification, audience)}
+
+	// Wait for the worker to pick up the first push so the queue is empty
+	<-arrived
+
+	futures = append(futures, dispatcher.SendAsync(notification, audience), dispatcher.SendAsync(notification, audience))
+
+	overflow := dispatcher.SendAsync(notification, audience)
+
+	if result := overflow.Result(); result.Err != ErrQueueFull {
+		t.Fatal("Expected ErrQueueFull, got", result.Err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if _, err := futures[0].Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Wait should time out while the server is blocked, got", err)
+	}
+
+	shutdownErr := make(chan error)
+
+	go func() {
+		shutdownErr <- dispatcher.Shutdown(context.Background())
+	}()
+
+	close(release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, future := range futures {
+		if result := future.Result(); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	if atomic.LoadInt32(&handled) != 3 {
+		t.Fatal("Shutdown should drain every queued push", handled)
+	}
+
+	if result := dispatcher.SendAsync(notification, audience).Result(); result.Err != ErrDispatcherClosed {
+		t.Fatal("Expected ErrDispatcherClosed, got", result.Err)
+	}
+}
+
+func TestAsyncDispatcherShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer testServer.Close()
+	defer close(release)
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	dispatcher := NewAsyncDispatcher(&pushBots, 1, 1)
+	dispatcher.SendAsync(Notification{Platform: PlatformIos, Msg: msg}, Audience{Token: token})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := dispatcher.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected the shutdown to time out, got", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"sync"
+	"time"
+)
+
+// Calls a function every interval in a background goroutine until stopped.
+// The zero value is ready to use.
+type backgroundLoop struct {
+	lock    sync.Mutex
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+// Calls run right away and then every interval, unless the loop is already
+// running. time.NewTicker panics on an interval that isn't positive, in the
+// goroutine where the caller can't recover, so it is refused here instead.
+func (loop *backgroundLoop) start(interval time.Duration, run func()) error {
+	if interval <= 0 {
+		return newValidationError("interval", interval.String(), "Interval needs to be positive")
+	}
+
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+
+	if loop.quit != nil {
+		return nil
+	}
+
+	loop.quit = make(chan struct{})
+	loop.stopped = make(chan struct{})
+
+	go func(quit, stopped chan struct{}) {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			run()
+
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(loop.quit, loop.stopped)
+
+	return nil
+}
+
+// Stops the loop and waits for the current run to finish, it may be started again
+func (loop *backgroundLoop) stop() {
+	loop.lock.Lock()
+	quit, stopped := loop.quit, loop.stopped
+	loop.quit, loop.stopped = nil, nil
+	loop.lock.Unlock()
+
+	if quit != nil {
+		close(quit)
+		<-stopped
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Run with go test -run '^$' -bench . to see the allocations of every call
+
+func newBenchmarkPushBots(b *testing.B) (*PushBots, func()) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	return &pushBots, testServer.Close
+}
+
+func BenchmarkSendPushToDevice(b *testing.B) {
+	pushBots, done := newBenchmarkPushBots(b)
+	defer done()
+
+	payload := map[string]interface{}{"screen": "offers", "id": 42}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := pushBots.SendPushToDevice(PlatformIos, token, msg, sound, badge, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchLargePayload(b *testing.B) {
+	pushBots, done := newBenchmarkPushBots(b)
+	defer done()
+
+	payload := make(map[string]interface{})
+
+	for i := 0; i < 200; i++ {
+		payload[fmt.Sprintf("key%d", i)] = fmt.Sprintf("A somewhat longer value number %d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := pushBots.Batch(PlatformIos, msg, sound, badge, []string{tag1}, nil, nil, nil, "", "", payload)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CampaignVariant is one part of a campaign, e.g. a locale or a segment,
+// sent as its own calls. Empty fields use those of the campaign.
+type CampaignVariant struct {
+	Name     string
+	Msg      string
+	Sound    string
+	Badge    string
+	Payload  map[string]interface{} // Merged into the payload of the campaign
+	Audience *Audience
+}
+
+// CampaignCall records one API call made for a campaign
+type CampaignCall struct {
+	Variant    string        `json:"variant,omitempty"`
+	Platform   string        `json:"platform"`
+	Audience   Audience      `json:"audience"`
+	TrackingId string        `json:"tracking_id,omitempty"`
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration_ns"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// PlatformSummary counts the calls of a campaign for one platform
+type PlatformSummary struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// CampaignReport describes everything a campaign sent, ready to be encoded as JSON
+type CampaignReport struct {
+	Campaign  string                      `json:"campaign"`
+	Started   time.Time                   `json:"started"`
+	Finished  time.Time                   `json:"finished"`
+	Duration  time.Duration               `json:"duration_ns"`
+	Calls     []CampaignCall              `json:"calls"`
+	Platforms map[string]*PlatformSummary `json:"platforms"`
+	Errors    []string                    `json:"errors,omitempty"`
+}
+
+// Campaign groups every call sending one notification: one call per platform
+// for the campaign itself or for each of its variants, and any follow ups.
+// It is safe for concurrent use, calls are made one at a time.
+type Campaign struct {
+	Name         string
+	Notification Notification
+	Audience     Audience
+	Variants     []CampaignVariant
+	// Embed a tracking id and the campaign name in every payload, see Track
+	Track bool
+
+	pushBots *PushBots
+	lock     sync.Mutex
+	report   CampaignReport
+}
+
+// Create a campaign sending notification to audience through pushBots
+func NewCampaign(pushBots *PushBots, name string, notification Notification, audience Audience) *Campaign {
+	return &Campaign{
+		Name:         name,
+		Notification: notification,
+		Audience:     audience,
+		pushBots:     pushBots,
+		report:       CampaignReport{Campaign: name, Platforms: make(map[string]*PlatformSummary)},
+	}
+}
+
+// Run sends the campaign, or each of its variants when it has any.
+// Failed calls don't stop the others, they are reported in the returned
+// report and summarized in the error.
+func (campaign *Campaign) Run() (CampaignReport, error) {
+	campaign.lock.Lock()
+	defer campaign.lock.Unlock()
+
+	calls := len(campaign.report.Calls)
+
+	if len(campaign.Variants) == 0 {
+		campaign.send("", campaign.Notification, campaign.Audience)
+	}
+
+	for _, variant := range campaign.Variants {
+		notification, audience := campaign.variant(variant)
+		campaign.send(variant.Name, notification, audience)
+	}
+
+	return campaign.result(campaign.report.Calls[calls:])
+}
+
+// FollowUp sends another notification as part of the campaign, reported under name
+func (campaign *Campaign) FollowUp(name string, notification Notification, audience Audience) (CampaignReport, error) {
+	campaign.lock.Lock()
+	defer campaign.lock.Unlock()
+
+	calls := len(campaign.report.Calls)
+	campaign.send(name, notification, audience)
+
+	return campaign.result(campaign.report.Calls[calls:])
+}
+
+// Report returns a copy of the report of every call made so far
+func (campaign *Campaign) Report() CampaignReport {
+	campaign.lock.Lock()
+	defer campaign.lock.Unlock()
+
+	return campaign.copyReport()
+}
+
+// Applies a variant to the notification and audience of the campaign
+func (campaign *Campaign) variant(variant CampaignVariant) (Notification, Audience) {
+	notification := overrideNotification(campaign.Notification, variant.Msg, variant.Sound, variant.Badge, variant.Payload)
+	audience := campaign.Audience
+
+	if variant.Audience != nil {
+		audience = *variant.Audience
+	}
+
+	return notification, audience
+}
+
+// Returns notification with every non empty value replaced and payload merged into its payload
+func overrideNotification(notification Notification, msg, sound, badge string, payload map[string]interface{}) Notification {
+	if msg != "" {
+		notification.Msg = msg
+	}
+
+	if sound != "" {
+		notification.Sound = sound
+	}
+
+	if badge != "" {
+		notification.Badge = badge
+	}
+
+	if len(payload) > 0 {
+		merged := make(map[string]interface{}, len(notification.Payload)+len(payload))
+
+		for key, value := range notification.Payload {
+			merged[key] = value
+		}
+
+		for key, value := range payload {
+			merged[key] = value
+		}
+
+		notification.Payload = merged
+	}
+
+	return notification
+}
+
+// Sends one notification per platform, devices addressed by token get the platform as given.
+// Must be called with the lock held.
+func (campaign *Campaign) send(variant string, notification Notification, audience Audience) {
+	platforms := []string{notification.Platform}
+
+	if notification.Platform == PlatformAll && audience.Token == "" && len(audience.Tokens) == 0 {
+		platforms = []string{PlatformIos, PlatformAndroid}
+	}
+
+	for _, platform := range platforms {
+		perPlatform := notification
+		perPlatform.Platform = platform
+
+		call := CampaignCall{Variant: variant, Platform: platformName(platform), Audience: audience}
+
+		if campaign.Track {
+			perPlatform, call.TrackingId = Track(perPlatform, campaign.Name)
+		}
+
+		call.Started = time.Now()
+		err := campaign.pushBots.SendNotification(perPlatform, audience)
+		call.Duration = time.Since(call.Started)
+
+		campaign.record(call, err)
+	}
+}
+
+// Must be called with the lock held
+func (campaign *Campaign) record(call CampaignCall, err error) {
+	report := &campaign.report
+
+	if report.Started.IsZero() {
+		report.Started = call.Started
+	}
+
+	report.Finished = call.Started.Add(call.Duration)
+	report.Duration = report.Finished.Sub(report.Started)
+
+	summary := report.Platforms[call.Platform]
+
+	if summary == nil {
+		summary = &PlatformSummary{}
+		report.Platforms[call.Platform] = summary
+	}
+
+	if err != nil {
+		call.Error = err.Error()
+		summary.Failed++
+
+		message := fmt.Sprintf("%s on %s: %s", call.Variant, call.Platform, err)
+
+		if call.Variant == "" {
+			message = fmt.Sprintf("%s: %s", call.Platform, err)
+		}
+
+		report.Errors = append(report.Errors, message)
+	} else {
+		summary.Succeeded++
+	}
+
+	report.Calls = append(report.Calls, call)
+}
+
+// Must be called with the lock held
+func (campaign *Campaign) result(calls []CampaignCall) (CampaignReport, error) {
+	failed := 0
+
+	for _, call := range calls {
+		if call.Error != "" {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return campaign.copyReport(), fmt.Errorf("Campaign %q: %d of %d calls failed", campaign.Name, failed, len(calls))
+	}
+
+	return campaign.copyReport(), nil
+}
+
+// Must be called with the lock held
+func (campaign *Campaign) copyReport() CampaignReport {
+	report := campaign.report
+	report.Calls = append([]CampaignCall(nil), report.Calls...)
+	report.Errors = append([]string(nil), report.Errors...)
+	report.Platforms = make(map[string]*PlatformSummary, len(campaign.report.Platforms))
+
+	for platform, summary := range campaign.report.Platforms {
+		copied := *summary
+		report.Platforms[platform] = &copied
+	}
+
+	return report
+}
+
+// Returns a readable name for a platform constant
+func platformName(platform string) string {
+	switch platform {
+	case PlatformIos:
+		return "ios"
+	case PlatformAndroid:
+		return "android"
+	case PlatformAll:
+		return "all"
+	}
+
+	return platform
+}
@@ -0,0 +1,97 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCampaign(t *testing.T) {
+	var lock sync.Mutex
+	var requests []apiRequest
+
+	// Android batches fail
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args apiRequest
+		json.NewDecoder(r.Body).Decode(&args)
+
+		lock.Lock()
+		requests = append(requests, args)
+		lock.Unlock()
+
+		if args.Platform == PlatformAndroid {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	campaign := NewCampaign(&pushBots, "spring-sale", Notification{Platform: PlatformAll, Msg: "Sale!", Sound: sound},
+		Audience{Tags: []string{"en"}})
+	campaign.Track = true
+	campaign.Variants = []CampaignVariant{
+		{Name: "en"},
+		{Name: "sv", Msg: "Rea!", Audience: &Audience{Tags: []string{"sv"}}, Payload: map[string]interface{}{"locale": "sv"}},
+	}
+
+	report, err := campaign.Run()
+
+	if err == nil {
+		t.Fatal("Expected the android calls to be reported as failed")
+	}
+
+	if len(report.Calls) != 4 || len(requests) != 4 {
+		t.Fatal("Expected a call per variant and platform", report.Calls)
+	}
+
+	sv := requests[2]
+
+	if sv.Msg != "Rea!" || sv.Tags[0] != "sv" || sv.Payload["locale"] != "sv" || sv.Payload[CampaignPayloadKey] != "spring-sale" {
+		t.Fatal("Variant not applied", sv)
+	}
+
+	if report.Calls[2].TrackingId == "" || report.Calls[2].TrackingId != sv.Payload[TrackingIdPayloadKey] {
+		t.Fatal("Tracking id not reported", report.Calls[2])
+	}
+
+	if ios := report.Platforms["ios"]; ios.Succeeded != 2 || ios.Failed != 0 {
+		t.Fatal("Wrong ios summary", ios)
+	}
+
+	if android := report.Platforms["android"]; android.Succeeded != 0 || android.Failed != 2 || len(report.Errors) != 2 {
+		t.Fatal("Wrong android summary", android, report.Errors)
+	}
+
+	// Follow ups are added to the same report
+	if _, err := campaign.FollowUp("reminder", Notification{Platform: PlatformIos, Msg: "Last day!", Sound: sound},
+		Audience{Tags: []string{"en"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report = campaign.Report()
+
+	if len(report.Calls) != 5 || report.Calls[4].Variant != "reminder" || report.Platforms["ios"].Succeeded != 3 {
+		t.Fatal("Follow up not reported", report)
+	}
+
+	encoded, err := json.Marshal(report)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(encoded, &decoded)
+
+	if decoded["campaign"] != "spring-sale" || len(decoded["calls"].([]interface{})) != 5 {
+		t.Fatal("Report not serialized", string(encoded))
+	}
+}
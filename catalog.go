@@ -0,0 +1,205 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Catalog holds translated messages keyed by message id and locale.
+//
+// Lookups walk a fallback chain: the exact locale, its parents ("pt-BR" -> "pt"),
+// any explicit fallbacks registered with SetFallbacks and finally DefaultLocale.
+type Catalog struct {
+	DefaultLocale string
+	messages      map[string]map[string]string // locale -> message id -> message
+	fallbacks     map[string][]string
+}
+
+// Creates an empty catalog falling back to defaultLocale
+func NewCatalog(defaultLocale string) *Catalog {
+	return &Catalog{
+		DefaultLocale: normalizeLocale(defaultLocale),
+		messages:      make(map[string]map[string]string),
+		fallbacks:     make(map[string][]string),
+	}
+}
+
+// Add a translated message
+func (catalog *Catalog) Add(locale, messageId, msg string) {
+	locale = normalizeLocale(locale)
+
+	if catalog.messages[locale] == nil {
+		catalog.messages[locale] = make(map[string]string)
+	}
+
+	catalog.messages[locale][messageId] = msg
+}
+
+// SetFallbacks registers the locales to try, in order, when locale has no translation
+func (catalog *Catalog) SetFallbacks(locale string, fallbacks ...string) {
+	normalized := make([]string, len(fallbacks))
+
+	for i, fallback := range fallbacks {
+		normalized[i] = normalizeLocale(fallback)
+	}
+
+	catalog.fallbacks[normalizeLocale(locale)] = normalized
+}
+
+// Load messages from a file laid out as {"locale": {"message id": "message"}}.
+// unmarshal decodes the file, nil means JSON. For YAML files pass e.g yaml.Unmarshal
+// from gopkg.in/yaml.v2, anything producing a map[string]map[string]string works.
+func (catalog *Catalog) LoadFile(path string, unmarshal func([]byte, interface{}) error) error {
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	return catalog.Load(content, unmarshal)
+}
+
+// Same as LoadFile but for content already in memory
+func (catalog *Catalog) Load(content []byte, unmarshal func([]byte, interface{}) error) error {
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+
+	locales := make(map[string]map[string]string)
+
+	if err := unmarshal(content, &locales); err != nil {
+		return fmt.Errorf("Could not decode message catalog: %s", err)
+	}
+
+	for locale, messages := range locales {
+		for messageId, msg := range messages {
+			catalog.Add(locale, messageId, msg)
+		}
+	}
+
+	return nil
+}
+
+// Locales returns every locale with at least one message, sorted
+func (catalog *Catalog) Locales() []string {
+	locales := make([]string, 0, len(catalog.messages))
+
+	for locale := range catalog.messages {
+		locales = append(locales, locale)
+	}
+
+	sort.Strings(locales)
+
+	return locales
+}
+
+// FallbackChain returns the locales tried, in order, when looking up a message for locale
+func (catalog *Catalog) FallbackChain(locale string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+
+	add := func(candidate string) {
+		if candidate != "" && !seen[candidate] {
+			seen[candidate] = true
+			chain = append(chain, candidate)
+		}
+	}
+
+	var walk func(string)
+	walk = func(candidate string) {
+		for candidate != "" {
+			if seen[candidate] {
+				return
+			}
+
+			add(candidate)
+
+			for _, fallback := range catalog.fallbacks[candidate] {
+				walk(fallback)
+			}
+
+			candidate = parentLocale(candidate)
+		}
+	}
+
+	walk(normalizeLocale(locale))
+	walk(catalog.DefaultLocale)
+
+	return chain
+}
+
+// Lookup returns the message for messageId in the best matching locale,
+// together with the locale the message was found in
+func (catalog *Catalog) Lookup(messageId, locale string) (string, string, error) {
+	for _, candidate := range catalog.FallbackChain(locale) {
+		if msg, found := catalog.messages[candidate][messageId]; found {
+			return msg, candidate, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("No translation of %q for locale %q", messageId, locale)
+}
+
+// LocaleErrors holds the error of every locale that failed, keyed by locale tag
+type LocaleErrors map[string]error
+
+func (localeErrors LocaleErrors) Error() string {
+	return formatErrorMap("Localized push failed for ", localeErrors)
+}
+
+// Push a translated message to devices tagged with their locale.
+// One Batch is issued per locale tag, targeting devices with that tag, with Msg
+// looked up in the catalog. Platform, sound, badge and payload come from notification.
+// Every translation is resolved before anything is sent; failed batches are
+// reported in a LocaleErrors.
+func (pushbots *PushBots) BatchLocalized(catalog *Catalog, messageId string, localeTags []string, notification Notification) error {
+	messages := make(map[string]string, len(localeTags))
+
+	for _, localeTag := range localeTags {
+		msg, _, err := catalog.Lookup(messageId, localeTag)
+
+		if err != nil {
+			return err
+		}
+
+		messages[localeTag] = msg
+	}
+
+	localeErrors := make(LocaleErrors)
+
+	for _, localeTag := range localeTags {
+		err := pushbots.Batch(notification.Platform, messages[localeTag], notification.Sound, notification.Badge,
+			[]string{localeTag}, nil, nil, nil, "", "", notification.Payload)
+
+		if err != nil {
+			localeErrors[localeTag] = err
+		}
+	}
+
+	if len(localeErrors) > 0 {
+		return localeErrors
+	}
+
+	return nil
+}
+
+// Locales are compared case insensitively and with "-" and "_" treated alike
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// "zh-hant-tw" -> "zh-hant" -> "zh" -> ""
+func parentLocale(locale string) string {
+	if index := strings.LastIndex(locale, "-"); index > 0 {
+		return locale[:index]
+	}
+
+	return ""
+}
@@ -0,0 +1,140 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const catalogJSON = `{
+	"en":    {"welcome": "Welcome", "bye": "Bye"},
+	"sv":    {"welcome": "Välkommen"},
+	"pt":    {"welcome": "Bem-vindo"},
+	"pt_BR": {"bye": "Tchau"},
+	"nb":    {"welcome": "Velkommen"}
+}`
+
+func newTestCatalog(t *testing.T) *Catalog {
+	dir, err := ioutil.TempDir("", "catalog")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "messages.json")
+
+	if err := ioutil.WriteFile(path, []byte(catalogJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := NewCatalog("en")
+
+	if err := catalog.LoadFile(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog.SetFallbacks("nn", "nb")
+
+	return catalog
+}
+
+func TestCatalogLookup(t *testing.T) {
+	t.Parallel()
+	catalog := newTestCatalog(t)
+
+	cases := []struct {
+		messageId, locale, msg, foundIn string
+	}{
+		{"welcome", "sv", "Välkommen", "sv"},
+		{"welcome", "sv-FI", "Välkommen", "sv"},
+		{"welcome", "pt-BR", "Bem-vindo", "pt"},
+		{"bye", "pt-BR", "Tchau", "pt-br"},
+		{"bye", "pt", "Bye", "en"},
+		{"welcome", "nn", "Velkommen", "nb"},
+		{"welcome", "de", "Welcome", "en"},
+	}
+
+	for _, c := range cases {
+		msg, foundIn, err := catalog.Lookup(c.messageId, c.locale)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg != c.msg || foundIn != c.foundIn {
+			t.Fatalf("Lookup(%s, %s) = %s (%s), expected %s (%s)", c.messageId, c.locale, msg, foundIn, c.msg, c.foundIn)
+		}
+	}
+
+	if _, _, err := catalog.Lookup("missing", "sv"); err == nil {
+		t.Fatal("Missing message should return an error")
+	}
+
+	if chain := catalog.FallbackChain("pt_BR"); !reflect.DeepEqual(chain, []string{"pt-br", "pt", "en"}) {
+		t.Fatal("Wrong fallback chain", chain)
+	}
+
+	if err := catalog.Load([]byte("not json"), nil); err == nil {
+		t.Fatal("Malformed catalog should fail to load")
+	}
+}
+
+func TestBatchLocalized(t *testing.T) {
+	var lock sync.Mutex
+	sent := make(map[string]string)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args apiRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(args.Tags) != 1 {
+			t.Fatal("Expected exactly one locale tag", args.Tags)
+		}
+
+		lock.Lock()
+		sent[args.Tags[0]] = args.Msg
+		lock.Unlock()
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	catalog := newTestCatalog(t)
+	notification := Notification{Platform: PlatformIos}
+
+	if err := pushBots.BatchLocalized(catalog, "welcome", []string{"sv", "pt-BR", "de"}, notification); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"sv": "Välkommen", "pt-BR": "Bem-vindo", "de": "Welcome"}
+
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatal("Wrong messages sent", sent)
+	}
+
+	if err := pushBots.BatchLocalized(catalog, "missing", []string{"sv"}, notification); err == nil {
+		t.Fatal("Missing translation should fail")
+	}
+
+	err := pushBots.BatchLocalized(catalog, "welcome", []string{"sv"}, Notification{Platform: PlatformAll})
+
+	if localeErrors, ok := err.(LocaleErrors); !ok || localeErrors["sv"] == nil {
+		t.Fatalf("Expected LocaleErrors for sv, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned without making a request while the circuit of an endpoint is open
+var ErrCircuitOpen = errors.New("Circuit open, request not sent")
+
+// CircuitState is the state of the circuit of one endpoint
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Requests are sent
+	CircuitOpen                         // Requests fail right away with ErrCircuitOpen
+	CircuitHalfOpen                     // A few trial requests are sent to see if the endpoint recovered
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// CircuitBreaker stops sending to an endpoint that keeps failing, so an
+// outage fails fast instead of every call waiting on timeouts. Each endpoint
+// key (registerdevice, pushone, ...) has its own circuit. Connection errors
+// and 5xx responses count as failures.
+//
+// A circuit opens after FailureThreshold failures in a row, stays open for
+// OpenTimeout, then lets HalfOpenRequests trial requests through; the circuit
+// closes if they all succeed and opens again on any failure.
+// Configure it before use, it is then safe for concurrent use.
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+	// Called with the endpoint key whenever a circuit changes state, may be nil
+	OnStateChange func(endpoint string, from, to CircuitState)
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state      CircuitState
+	generation uint64 // Changes on every transition, results of requests allowed before one are stale
+	failures   int
+	openedAt   time.Time
+	inFlight   int // Trial requests sent while half open
+	successes  int // Trial requests that succeeded
+}
+
+type stateChange struct {
+	endpoint string
+	from, to CircuitState
+}
+
+// Create a circuit breaker opening after failureThreshold failures for openTimeout,
+// with a single trial request when half open
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		HalfOpenRequests: 1,
+		Now:              time.Now,
+		circuits:         make(map[string]*circuit),
+	}
+}
+
+// State returns the current state of the circuit of an endpoint key
+func (breaker *CircuitBreaker) State(endpoint string) CircuitState {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	circuit := breaker.circuit(endpoint)
+
+	// An open circuit past its timeout would let the next request through
+	if circuit.state == CircuitOpen && !breaker.Now().Before(circuit.openedAt.Add(breaker.OpenTimeout)) {
+		return CircuitHalfOpen
+	}
+
+	return circuit.state
+}
+
+func (breaker *CircuitBreaker) circuit(endpoint string) *circuit {
+	if breaker.circuits == nil {
+		breaker.circuits = make(map[string]*circuit)
+	}
+
+	found, exists := breaker.circuits[endpoint]
+
+	if !exists {
+		found = &circuit{}
+		breaker.circuits[endpoint] = found
+	}
+
+	return found
+}
+
+// Must be called with the lock held
+func (breaker *CircuitBreaker) transition(endpoint string, circuit *circuit, to CircuitState, changes []stateChange) []stateChange {
+	changes = append(changes, stateChange{endpoint: endpoint, from: circuit.state, to: to})
+
+	circuit.state = to
+	circuit.generation++
+	circuit.failures = 0
+	circuit.inFlight = 0
+	circuit.successes = 0
+
+	if to == CircuitOpen {
+		circuit.openedAt = breaker.Now()
+	}
+
+	return changes
+}
+
+func (breaker *CircuitBreaker) notify(changes []stateChange) {
+	if breaker.OnStateChange == nil {
+		return
+	}
+
+	for _, change := range changes {
+		breaker.OnStateChange(change.endpoint, change.from, change.to)
+	}
+}
+
+func (breaker *CircuitBreaker) halfOpenRequests() int {
+	if breaker.HalfOpenRequests < 1 {
+		return 1
+	}
+
+	return breaker.HalfOpenRequests
+}
+
+// Returns ErrCircuitOpen if no request may be sent to endpoint now, otherwise
+// the generation of the circuit to pass to record with the outcome
+func (breaker *CircuitBreaker) allow(endpoint string) (uint64, error) {
+	var changes []stateChange
+	defer func() { breaker.notify(changes) }()
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	circuit := breaker.circuit(endpoint)
+
+	if circuit.state == CircuitOpen {
+		if breaker.Now().Before(circuit.openedAt.Add(breaker.OpenTimeout)) {
+			return 0, ErrCircuitOpen
+		}
+
+		changes = breaker.transition(endpoint, circuit, CircuitHalfOpen, changes)
+	}
+
+	if circuit.state == CircuitHalfOpen {
+		if circuit.inFlight >= breaker.halfOpenRequests() {
+			return 0, ErrCircuitOpen
+		}
+
+		circuit.inFlight++
+	}
+
+	return circuit.generation, nil
+}
+
+// Records the outcome of a request allowed by allow with the generation it returned.
+// A request allowed before the circuit last changed state doesn't count, a slow
+// request sent while closed mustn't close a circuit that has opened since.
+func (breaker *CircuitBreaker) record(endpoint string, generation uint64, failed bool) {
+	var changes []stateChange
+	defer func() { breaker.notify(changes) }()
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	circuit := breaker.circuit(endpoint)
+
+	if generation != circuit.generation {
+		return
+	}
+
+	switch circuit.state {
+	case CircuitClosed:
+		if !failed {
+			circuit.failures = 0
+			return
+		}
+
+		circuit.failures++
+
+		if circuit.failures >= breaker.FailureThreshold {
+			changes = breaker.transition(endpoint, circuit, CircuitOpen, changes)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			changes = breaker.transition(endpoint, circuit, CircuitOpen, changes)
+			return
+		}
+
+		circuit.successes++
+
+		if circuit.successes >= breaker.halfOpenRequests() {
+			changes = breaker.transition(endpoint, circuit, CircuitClosed, changes)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var down int32 = 1
+	var calls int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer testServer.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	var changes []string
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.CircuitBreaker = NewCircuitBreaker(3, time.Minute)
+	pushBots.CircuitBreaker.Now = func() time.Time { return now }
+	pushBots.CircuitBreaker.OnStateChange = func(endpoint string, from, to CircuitState) {
+		changes = append(changes, endpoint+" "+from.String()+" "+to.String())
+	}
+
+	send := func() error {
+		return pushBots.SendPushToDevice(PlatformIos, token, msg, sound, badge, nil)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := send(); err == nil || err == ErrCircuitOpen {
+			t.Fatal("Expected a server error", err)
+		}
+	}
+
+	if err := send(); err != ErrCircuitOpen || calls != 3 {
+		t.Fatal("Expected the circuit to be open", err, calls)
+	}
+
+	// Other endpoints have their own circuit
+	if err := pushBots.Badge(token, PlatformIos, 1); err == ErrCircuitOpen {
+		t.Fatal("Badge circuit should be closed")
+	}
+
+	// A failed trial opens the circuit again
+	now = now.Add(time.Minute)
+
+	if state := pushBots.CircuitBreaker.State("pushone"); state != CircuitHalfOpen {
+		t.Fatal("Expected half open after the timeout", state)
+	}
+
+	if err := send(); err == nil || err == ErrCircuitOpen {
+		t.Fatal("Expected the trial request to be sent", err)
+	}
+
+	if err := send(); err != ErrCircuitOpen {
+		t.Fatal("Expected the circuit to open again", err)
+	}
+
+	// A successful trial closes it
+	atomic.StoreInt32(&down, 0)
+	now = now.Add(time.Minute)
+
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := pushBots.CircuitBreaker.State("pushone"); state != CircuitClosed {
+		t.Fatal("Expected the circuit to be closed", state)
+	}
+
+	expected := []string{
+		"pushone closed open",
+		"pushone open half-open",
+		"pushone half-open open",
+		"pushone open half-open",
+		"pushone half-open closed",
+	}
+
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatal("Wrong state changes", changes)
+	}
+}
+
+func TestCircuitBreakerHalfOpenLimit(t *testing.T) {
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	breaker := NewCircuitBreaker(1, time.Second)
+	breaker.HalfOpenRequests = 2
+	breaker.Now = func() time.Time { return now }
+
+	generation, _ := breaker.allow("badge")
+	breaker.record("badge", generation, true)
+	now = now.Add(time.Second)
+
+	first, firstErr := breaker.allow("badge")
+	second, secondErr := breaker.allow("badge")
+
+	if firstErr != nil || secondErr != nil {
+		t.Fatal("Expected two trial requests")
+	}
+
+	if _, err := breaker.allow("badge"); err != ErrCircuitOpen {
+		t.Fatal("Expected a third request to be refused while trials are in flight")
+	}
+
+	breaker.record("badge", first, false)
+
+	if breaker.State("badge") != CircuitHalfOpen {
+		t.Fatal("Every trial needs to succeed before closing")
+	}
+
+	breaker.record("badge", second, false)
+
+	if breaker.State("badge") != CircuitClosed {
+		t.Fatal("Expected the circuit to close")
+	}
+}
+
+func TestCircuitBreakerIgnoresStaleResults(t *testing.T) {
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	breaker := NewCircuitBreaker(1, time.Second)
+	breaker.Now = func() time.Time { return now }
+
+	// A slow request is sent while closed, another one fails and opens the circuit
+	slow, _ := breaker.allow("badge")
+	failing, _ := breaker.allow("badge")
+	breaker.record("badge", failing, true)
+	now = now.Add(time.Second)
+
+	trial, err := breaker.allow("badge")
+
+	if err != nil {
+		t.Fatal("Expected a trial request", err)
+	}
+
+	breaker.record("badge", slow, false)
+
+	if breaker.State("badge") != CircuitHalfOpen {
+		t.Fatal("A request sent before the circuit opened must not close it", breaker.State("badge"))
+	}
+
+	breaker.record("badge", trial, false)
+
+	if breaker.State("badge") != CircuitClosed {
+		t.Fatal("Expected the trial to close the circuit")
+	}
+}
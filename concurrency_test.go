@@ -0,0 +1,173 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Run with go test -race, every public method of a single shared client is
+// called from many goroutines at once.
+func TestConcurrentUse(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+	pushBots.RateLimiter = NewRateLimiter(0, 1)
+	pushBots.Credentials = StaticCredentials{AppId: appId, Secret: secret}
+	pushBots.HttpClient = &http.Client{}
+
+	notification := Notification{Platform: PlatformIos, Msg: msg, Sound: sound}
+	notificationTemplate, err := NewNotificationTemplate(Notification{Platform: PlatformIos, Msg: "Hi {{.Name}}"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := NewCatalog("en")
+	catalog.Add("en", "welcome", "Welcome")
+
+	calls := []func(string) error{
+		func(token string) error {
+			return pushBots.RegisterDevice(token, PlatformIos, lat, lng, []string{notificationType1}, []string{tag1}, alias)
+		},
+		func(token string) error {
+			return pushBots.Register(Device{Token: token, Platform: PlatformIos, TimeZone: "UTC"})
+		},
+		func(token string) error { return pushBots.TagDevice(token, PlatformIos, "", tag2) },
+		func(token string) error { return pushBots.UnTagDevice(token, PlatformIos, "", tag2) },
+		func(token string) error { return pushBots.Geo(token, PlatformIos, lat, lng) },
+		func(token string) error {
+			return pushBots.GeoCoordinates(token, PlatformIos, Coordinates{Lat: 1, Lng: 2})
+		},
+		func(token string) error {
+			return pushBots.GeoPush(PlatformIos, msg, sound, badge, Coordinates{Lat: 1, Lng: 2}, 10, nil)
+		},
+		func(token string) error {
+			return pushBots.AddNotificationType(token, PlatformIos, "", notificationType2)
+		},
+		func(token string) error {
+			return pushBots.RemoveNotificationType(token, PlatformIos, "", notificationType2)
+		},
+		func(token string) error { return pushBots.Broadcast(PlatformAll, msg, sound, badge, nil) },
+		func(token string) error { return pushBots.SendPushToDevice(PlatformIos, token, msg, sound, badge, nil) },
+		func(token string) error {
+			return pushBots.Batch(PlatformIos, msg, sound, badge, []string{tag1}, nil, nil, nil, "", "", nil)
+		},
+		func(token string) error { return pushBots.Badge(token, PlatformIos, 3) },
+		func(token string) error { return pushBots.RecordAnalytics(token, PlatformIos, "o") },
+		func(token string) error { return pushBots.SendNotification(notification, Audience{Token: token}) },
+		func(token string) error {
+			return pushBots.SendNotification(notification, Audience{Tags: []string{tag1}})
+		},
+		func(token string) error {
+			return pushBots.SendTemplatedPush(notificationTemplate, TemplateRecipient{Token: token, Data: map[string]interface{}{"Name": token}})
+		},
+		func(token string) error {
+			return pushBots.BatchLocalized(catalog, "welcome", []string{"en", "sv"}, notification)
+		},
+		func(token string) error { return pushBots.SetAlias(token, PlatformIos, alias) },
+		func(token string) error { return pushBots.RemoveAlias(token, PlatformIos, alias) },
+		func(token string) error { return pushBots.SendPushToAlias(PlatformIos, alias, msg, sound, badge, nil) },
+		func(token string) error { return pushBots.BadgeAlias(alias, PlatformIos, 1) },
+		func(token string) error { return pushBots.GeoAlias(alias, PlatformIos, Coordinates{Lat: 3, Lng: 4}) },
+		func(token string) error { return pushBots.RecordAnalyticsAlias(alias, PlatformIos, "o") },
+		func(token string) error {
+			_, err := pushBots.AddTags(token, PlatformIos, "", []string{"a", "b"})
+			return err
+		},
+		func(token string) error {
+			_, err := pushBots.RemoveTags(token, PlatformIos, "", []string{"a"})
+			return err
+		},
+		func(token string) error {
+			_, err := pushBots.SetTags(token, PlatformIos, "", []string{"c"})
+			return err
+		},
+		func(token string) error { return pushBots.UnregisterAlias(alias, PlatformIos) },
+		func(token string) error { return pushBots.UnregisterDevice(token, PlatformIos) },
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 1000)
+
+	for worker := 0; worker < 8; worker++ {
+		for i, call := range calls {
+			wait.Add(1)
+
+			go func(call func(string) error, name string) {
+				defer wait.Done()
+
+				// Half the workers share a token to provoke contention on the same device
+				if err := call(name); err != nil {
+					errs <- err
+				}
+			}(call, fmt.Sprintf("token-%d-%d", worker%2, i%3))
+		}
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentMirrorUpdatesAreNotLost(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+
+	var wait sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+
+		go func(tag string) {
+			defer wait.Done()
+
+			if err := pushBots.TagDevice(token, PlatformIos, "", tag); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("tag-%d", i))
+	}
+
+	wait.Wait()
+
+	device, err := pushBots.Devices.Get(token)
+
+	if err != nil || len(device.Tags) != 50 {
+		t.Fatal("Every concurrent tag should be mirrored", len(device.Tags), err)
+	}
+}
+
+func TestZeroValueClientUsesDefaultEndpoints(t *testing.T) {
+	t.Parallel()
+
+	pushBots := PushBots{}
+
+	// Nothing is written to the client, so concurrent first use can't race
+	if _, err := pushBots.sendToEndpoint("missing", apiRequest{}); err == nil {
+		t.Fatal("Unknown endpoint should fail")
+	}
+
+	if pushBots.endpoints != nil {
+		t.Fatal("Zero value client should not be modified on use")
+	}
+
+	if defaultEndpoints["pushone"].Endpoint != productionEndPoint+"push/one" {
+		t.Fatal("Default endpoints should point at production")
+	}
+}
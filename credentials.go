@@ -0,0 +1,166 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Credentials identify an app to the PushBots API
+type Credentials struct {
+	AppId  string `json:"app_id"`
+	Secret string `json:"secret"`
+}
+
+// CredentialsProvider is consulted for every request, so credentials can be
+// rotated without rebuilding clients. Implementations must be safe for concurrent use.
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// StaticCredentials always returns the same credentials
+type StaticCredentials Credentials
+
+func (static StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(static), nil
+}
+
+// EnvCredentials reads the credentials from environment variables on every request
+type EnvCredentials struct {
+	AppIdVariable  string // Defaults to PUSHBOTS_APPID
+	SecretVariable string // Defaults to PUSHBOTS_SECRET
+}
+
+func (env EnvCredentials) Credentials() (Credentials, error) {
+	appIdVariable, secretVariable := env.AppIdVariable, env.SecretVariable
+
+	if appIdVariable == "" {
+		appIdVariable = "PUSHBOTS_APPID"
+	}
+
+	if secretVariable == "" {
+		secretVariable = "PUSHBOTS_SECRET"
+	}
+
+	return Credentials{AppId: os.Getenv(appIdVariable), Secret: os.Getenv(secretVariable)}, nil
+}
+
+// FileCredentials reads {"app_id": "...", "secret": "..."} from a file and
+// reloads it whenever the file changes. A file that fails to load keeps the
+// previous credentials in use, so a half written file never breaks requests.
+type FileCredentials struct {
+	path     string
+	onReload func(err error)
+
+	lock        sync.RWMutex
+	credentials Credentials
+	modified    time.Time
+	size        int64
+	loop        backgroundLoop
+}
+
+// Load credentials from path and check it for changes every interval until Close is called.
+// interval must be positive. onReload, if not nil, is called after every reload caused by a
+// change with its error.
+func NewFileCredentials(path string, interval time.Duration, onReload func(err error)) (*FileCredentials, error) {
+	fileCredentials := &FileCredentials{path: path, onReload: onReload}
+
+	if err := fileCredentials.Reload(); err != nil {
+		return nil, err
+	}
+
+	if err := fileCredentials.loop.start(interval, fileCredentials.reloadIfChanged); err != nil {
+		return nil, err
+	}
+
+	return fileCredentials, nil
+}
+
+func (fileCredentials *FileCredentials) Credentials() (Credentials, error) {
+	fileCredentials.lock.RLock()
+	defer fileCredentials.lock.RUnlock()
+
+	return fileCredentials.credentials, nil
+}
+
+// Reload reads the file right away
+func (fileCredentials *FileCredentials) Reload() error {
+	info, err := os.Stat(fileCredentials.path)
+
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(fileCredentials.path)
+
+	if err != nil {
+		return err
+	}
+
+	var credentials Credentials
+
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return err
+	}
+
+	if credentials.AppId == "" || credentials.Secret == "" {
+		return errors.New("Appid and/or secret key not set in credentials file")
+	}
+
+	fileCredentials.lock.Lock()
+	fileCredentials.credentials = credentials
+	fileCredentials.modified = info.ModTime()
+	fileCredentials.size = info.Size()
+	fileCredentials.lock.Unlock()
+
+	return nil
+}
+
+func (fileCredentials *FileCredentials) changed() bool {
+	info, err := os.Stat(fileCredentials.path)
+
+	if err != nil {
+		return false
+	}
+
+	fileCredentials.lock.RLock()
+	defer fileCredentials.lock.RUnlock()
+
+	return !info.ModTime().Equal(fileCredentials.modified) || info.Size() != fileCredentials.size
+}
+
+// Reloads the file when it changed since the last load
+func (fileCredentials *FileCredentials) reloadIfChanged() {
+	if !fileCredentials.changed() {
+		return
+	}
+
+	err := fileCredentials.Reload()
+
+	if fileCredentials.onReload != nil {
+		fileCredentials.onReload(err)
+	}
+}
+
+// Close stops watching the file
+func (fileCredentials *FileCredentials) Close() error {
+	fileCredentials.loop.stop()
+
+	return nil
+}
+
+// Returns the credentials to use for the next request
+func (pushbots *PushBots) currentCredentials() (Credentials, error) {
+	if pushbots.Credentials == nil {
+		return Credentials{AppId: pushbots.AppId, Secret: pushbots.Secret}, nil
+	}
+
+	return pushbots.Credentials.Credentials()
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaticAndEnvCredentials(t *testing.T) {
+	credentials, _ := StaticCredentials{AppId: appId, Secret: secret}.Credentials()
+
+	if credentials.AppId != appId || credentials.Secret != secret {
+		t.Fatal("Wrong static credentials", credentials)
+	}
+
+	os.Setenv("TEST_PUSHBOTS_APPID", "env-app")
+	os.Setenv("TEST_PUSHBOTS_SECRET", "env-secret")
+	defer os.Unsetenv("TEST_PUSHBOTS_APPID")
+	defer os.Unsetenv("TEST_PUSHBOTS_SECRET")
+
+	env := EnvCredentials{AppIdVariable: "TEST_PUSHBOTS_APPID", SecretVariable: "TEST_PUSHBOTS_SECRET"}
+	credentials, _ = env.Credentials()
+
+	if credentials.AppId != "env-app" || credentials.Secret != "env-secret" {
+		t.Fatal("Wrong environment credentials", credentials)
+	}
+
+	// Missing variables surface as the usual error on request
+	pushBots := NewPushBots("", "", false)
+	pushBots.Credentials = EnvCredentials{AppIdVariable: "TEST_PUSHBOTS_MISSING"}
+
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err == nil {
+		t.Fatal("Missing credentials should fail")
+	}
+}
+
+func TestFileCredentialsRotation(t *testing.T) {
+	var currentSecret atomic.Value
+	currentSecret.Store("secret-0")
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-pushbots-secret") != currentSecret.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer testServer.Close()
+
+	path, cleanup := tempPath(t, "credentials.json")
+	defer cleanup()
+
+	writeCredentials := func(secret string) {
+		content := fmt.Sprintf(`{"app_id": %q, "secret": %q}`, appId, secret)
+
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCredentials("secret-0")
+
+	if _, err := NewFileCredentials(path, 0, nil); err == nil {
+		t.Fatal("NewFileCredentials should refuse an interval that isn't positive")
+	}
+
+	reloaded := make(chan error, 10)
+	fileCredentials, err := NewFileCredentials(path, time.Millisecond, func(err error) { reloaded <- err })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fileCredentials.Close()
+
+	pushBots := NewPushBots("", "", false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Credentials = fileCredentials
+
+	var wait sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				pushBots.UnregisterDevice(token, PlatformIos)
+			}
+		}()
+	}
+
+	// The server switches secret first, then the file follows
+	for rotation := 1; rotation <= 3; rotation++ {
+		time.Sleep(5 * time.Millisecond)
+
+		secret := fmt.Sprintf("secret-%d", rotation)
+		currentSecret.Store(secret)
+		writeCredentials(secret)
+
+		if err := <-reloaded; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	close(stop)
+	wait.Wait()
+
+	if credentials, _ := fileCredentials.Credentials(); credentials.Secret != "secret-3" {
+		t.Fatal("Credentials were not reloaded", credentials)
+	}
+
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken file keeps the previous credentials
+	if err := ioutil.WriteFile(path, []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-reloaded; err == nil {
+		t.Fatal("Expected the broken file to fail to load")
+	}
+
+	if credentials, _ := fileCredentials.Credentials(); credentials.Secret != "secret-3" {
+		t.Fatal("Broken file should not replace credentials", credentials)
+	}
+}
+
+func TestCredentialsRotatedInFlight(t *testing.T) {
+	rotatable := &rotatingCredentials{credentials: Credentials{AppId: appId, Secret: "old"}}
+	var requests int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		// The secret is rotated while the first request is being handled
+		if r.Header.Get("x-pushbots-secret") == "old" {
+			rotatable.set(Credentials{AppId: appId, Secret: "new"})
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots("", "", false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Credentials = rotatable
+
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err != nil {
+		t.Fatal("Request should be retried with the rotated credentials", err)
+	}
+
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Fatal("Expected exactly one retry", requests)
+	}
+}
+
+type rotatingCredentials struct {
+	lock        sync.Mutex
+	credentials Credentials
+}
+
+func (rotating *rotatingCredentials) set(credentials Credentials) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	rotating.credentials = credentials
+}
+
+func (rotating *rotatingCredentials) Credentials() (Credentials, error) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	return rotating.credentials, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead Next looks before giving up on an expression that never matches, e.g "0 0 30 2 *"
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// CronSchedule is a parsed standard five field cron expression:
+// minute hour day-of-month month day-of-week.
+// Fields support "*", lists "1,2", ranges "1-5" and steps "*/15" or "0-30/10".
+// Day of week is 0-6 with 0 (or 7) being sunday. When both day fields are
+// restricted a time matches if either of them does, like in cron.
+type CronSchedule struct {
+	expression string
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDom     bool
+	anyDow     bool
+}
+
+// Bounds of every cron field, in expression order
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse a cron expression
+func ParseCron(expression string) (*CronSchedule, error) {
+	fields := strings.Fields(expression)
+
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Cron expression %q must have 5 fields, got %d", expression, len(fields))
+	}
+
+	bits := make([]uint64, len(fields))
+
+	for i, field := range fields {
+		parsed, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in cron expression %q: %s", cronFields[i].name, expression, err)
+		}
+
+		bits[i] = parsed
+	}
+
+	// Sunday may be written as both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &CronSchedule{
+		expression: expression,
+		minute:     bits[0],
+		hour:       bits[1],
+		dayOfMonth: bits[2],
+		month:      bits[3],
+		dayOfWeek:  bits[4],
+		anyDom:     fields[2] == "*",
+		anyDow:     fields[4] == "*",
+	}, nil
+}
+
+func (schedule *CronSchedule) String() string {
+	return schedule.expression
+}
+
+// Next returns the first matching time strictly after from, in from's location.
+// The zero time is returned if nothing matches within five years.
+func (schedule *CronSchedule) Next(from time.Time) time.Time {
+	location := from.Location()
+	current := from.Truncate(time.Minute).Add(time.Minute)
+	limit := from.Add(cronSearchLimit)
+
+	for current.Before(limit) {
+		if schedule.month&(1<<uint(current.Month())) == 0 {
+			current = cronAdvance(current, time.Date(current.Year(), current.Month()+1, 1, 0, 0, 0, 0, location))
+			continue
+		}
+
+		if !schedule.matchesDay(current) {
+			current = cronAdvance(current, time.Date(current.Year(), current.Month(), current.Day()+1, 0, 0, 0, 0, location))
+			continue
+		}
+
+		if schedule.hour&(1<<uint(current.Hour())) == 0 {
+			current = cronAdvance(current, time.Date(current.Year(), current.Month(), current.Day(), current.Hour()+1, 0, 0, 0, location))
+			continue
+		}
+
+		if schedule.minute&(1<<uint(current.Minute())) == 0 {
+			current = current.Add(time.Minute)
+			continue
+		}
+
+		return current
+	}
+
+	return time.Time{}
+}
+
+// Returns next when it is after current. A wall clock time inside a DST gap
+// may be normalized by time.Date to an earlier instant, the search then moves
+// on to the start of the next hour in absolute time so it always advances.
+func cronAdvance(current, next time.Time) time.Time {
+	if next.After(current) {
+		return next
+	}
+
+	return current.Add(time.Duration(60-current.Minute()) * time.Minute)
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := schedule.dayOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := schedule.dayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	if schedule.anyDom || schedule.anyDow {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+// Parses one field into a bitmask where bit n is set if n matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rangePart := part
+
+		if index := strings.Index(part, "/"); index >= 0 {
+			parsedStep, err := strconv.Atoi(part[index+1:])
+
+			if err != nil || parsedStep <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+
+			step = parsedStep
+			rangePart = part[:index]
+		}
+
+		start, end := min, max
+
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			parsedStart, err := strconv.Atoi(bounds[0])
+
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", rangePart)
+			}
+
+			start, end = parsedStart, parsedStart
+
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", rangePart)
+				}
+			} else if step != 1 {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
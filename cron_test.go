@@ -0,0 +1,122 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	t.Parallel()
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+
+	for _, expression := range invalid {
+		if _, err := ParseCron(expression); err == nil {
+			t.Fatalf("Expected %q to be rejected", expression)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	t.Parallel()
+
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+
+	if err != nil {
+		t.Skip("Time zone database not available")
+	}
+
+	from := time.Date(2016, 3, 25, 10, 30, 0, 0, stockholm) // A friday
+
+	cases := []struct {
+		expression string
+		expected   time.Time
+	}{
+		{"0 9 * * *", time.Date(2016, 3, 26, 9, 0, 0, 0, stockholm)},
+		{"*/15 * * * *", time.Date(2016, 3, 25, 10, 45, 0, 0, stockholm)},
+		{"0 9 * * 1-5", time.Date(2016, 3, 28, 9, 0, 0, 0, stockholm)},
+		{"0 9 * * 7", time.Date(2016, 3, 27, 9, 0, 0, 0, stockholm)},
+		{"0 0 1 * *", time.Date(2016, 4, 1, 0, 0, 0, 0, stockholm)},
+		{"0 12 29 2 *", time.Date(2020, 2, 29, 12, 0, 0, 0, stockholm)},
+		// Day of month or day of week when both are restricted
+		{"0 9 1 * 1", time.Date(2016, 3, 28, 9, 0, 0, 0, stockholm)},
+		// 02:30 does not exist on the night DST starts
+		{"30 2 27 3 *", time.Date(2017, 3, 27, 2, 30, 0, 0, stockholm)},
+	}
+
+	for _, c := range cases {
+		cronSchedule, err := ParseCron(c.expression)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if next := cronSchedule.Next(from); !next.Equal(c.expected) {
+			t.Fatalf("%s: expected %s, got %s", c.expression, c.expected, next)
+		}
+	}
+
+	never, _ := ParseCron("0 0 30 2 *")
+
+	if !never.Next(from).IsZero() {
+		t.Fatal("Expression that never matches should return the zero time")
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	t.Parallel()
+
+	newYork, err := time.LoadLocation("America/New_York")
+
+	if err != nil {
+		t.Skip("Time zone database not available")
+	}
+
+	// Clocks go from 02:00 to 03:00 on 2016-03-13 and back from 02:00 to 01:00 on 2016-11-06
+	cases := []struct {
+		expression string
+		from       time.Time
+		expected   time.Time
+	}{
+		{"30 2 * * *", time.Date(2016, 3, 12, 12, 0, 0, 0, newYork), time.Date(2016, 3, 14, 2, 30, 0, 0, newYork)},
+		{"0 2 * * *", time.Date(2016, 3, 13, 1, 59, 0, 0, newYork), time.Date(2016, 3, 14, 2, 0, 0, 0, newYork)},
+		{"0 0 * * *", time.Date(2016, 3, 12, 12, 0, 0, 0, newYork), time.Date(2016, 3, 13, 0, 0, 0, 0, newYork)},
+		{"0 3 * * *", time.Date(2016, 3, 13, 1, 0, 0, 0, newYork), time.Date(2016, 3, 13, 3, 0, 0, 0, newYork)},
+		{"30 2 * * *", time.Date(2016, 11, 5, 12, 0, 0, 0, newYork), time.Date(2016, 11, 6, 2, 30, 0, 0, newYork)},
+	}
+
+	for _, c := range cases {
+		cronSchedule, err := ParseCron(c.expression)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make(chan time.Time, 1)
+		go func() { result <- cronSchedule.Next(c.from) }()
+
+		select {
+		case next := <-result:
+			if !next.Equal(c.expected) {
+				t.Fatalf("%s from %s: expected %s, got %s", c.expression, c.from, c.expected, next)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s from %s: Next did not return", c.expression, c.from)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by device stores when a token is unknown
+var ErrDeviceNotFound = errors.New("Device not found")
+
+// Device is the locally known state of a device registered with PushBots
+type Device struct {
+	Token             string       `json:"token"`
+	Platform          string       `json:"platform"`
+	Alias             string       `json:"alias,omitempty"`
+	Tags              []string     `json:"tags,omitempty"`
+	NotificationTypes []string     `json:"notification_types,omitempty"`
+	Badge             int          `json:"badge"`
+	Location          *Coordinates `json:"location,omitempty"`
+	TimeZone          string       `json:"time_zone,omitempty"` // IANA name such as Europe/Stockholm, never sent to PushBots
+	Updated           time.Time    `json:"updated"`
+}
+
+// HasTag reports whether the device has tag
+func (device Device) HasTag(tag string) bool {
+	return containsString(device.Tags, tag)
+}
+
+// DeviceStore holds a local mirror of devices.
+// When PushBots.Devices is set every successful mutating call is applied to
+// the store, giving a queryable view of tags, aliases, notification types,
+// badge and location that the PushBots API itself cannot be asked for.
+//
+// Update applies fn to the device with token and saves it as one atomic step,
+// so concurrent updates of a device don't lose each other's changes. A token
+// that isn't stored yet is passed to fn as Device{Token: token}.
+type DeviceStore interface {
+	Get(token string) (Device, error)
+	ByAlias(alias string) ([]Device, error)
+	Save(device Device) error
+	Update(token string, fn func(device *Device)) error
+	Delete(token string) error
+	List() ([]Device, error)
+}
+
+// MemoryDeviceStore keeps devices in memory
+type MemoryDeviceStore struct {
+	lock    sync.RWMutex
+	devices map[string]Device
+}
+
+// Create an empty in memory device store
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{devices: make(map[string]Device)}
+}
+
+func (store *MemoryDeviceStore) Get(token string) (Device, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	device, found := store.devices[token]
+
+	if !found {
+		return Device{}, ErrDeviceNotFound
+	}
+
+	return copyDevice(device), nil
+}
+
+func (store *MemoryDeviceStore) ByAlias(alias string) ([]Device, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var devices []Device
+
+	for _, device := range store.devices {
+		if device.Alias == alias {
+			devices = append(devices, copyDevice(device))
+		}
+	}
+
+	sort.Sort(devicesByToken(devices))
+
+	return devices, nil
+}
+
+func (store *MemoryDeviceStore) Save(device Device) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.devices[device.Token] = copyDevice(device)
+	return nil
+}
+
+func (store *MemoryDeviceStore) Update(token string, fn func(device *Device)) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.update(token, fn)
+	return nil
+}
+
+// Applies fn to a copy of the device and stores it, the caller holds the lock
+func (store *MemoryDeviceStore) update(token string, fn func(device *Device)) {
+	device, found := store.devices[token]
+
+	if found {
+		device = copyDevice(device)
+	} else {
+		device = Device{Token: token}
+	}
+
+	fn(&device)
+	device.Token = token
+	store.devices[token] = copyDevice(device)
+}
+
+func (store *MemoryDeviceStore) Delete(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, found := store.devices[token]; !found {
+		return ErrDeviceNotFound
+	}
+
+	delete(store.devices, token)
+	return nil
+}
+
+func (store *MemoryDeviceStore) List() ([]Device, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	devices := make([]Device, 0, len(store.devices))
+
+	for _, device := range store.devices {
+		devices = append(devices, copyDevice(device))
+	}
+
+	sort.Sort(devicesByToken(devices))
+
+	return devices, nil
+}
+
+// FileDeviceStore is a MemoryDeviceStore persisted to a JSON file after every change
+type FileDeviceStore struct {
+	path string
+	*MemoryDeviceStore
+}
+
+// Open or create a file backed device store
+func NewFileDeviceStore(path string) (*FileDeviceStore, error) {
+	store := &FileDeviceStore{path: path, MemoryDeviceStore: NewMemoryDeviceStore()}
+
+	content, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+
+	if err := json.Unmarshal(content, &devices); err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		store.devices[device.Token] = device
+	}
+
+	return store, nil
+}
+
+func (store *FileDeviceStore) Save(device Device) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.devices[device.Token] = copyDevice(device)
+	return store.flush()
+}
+
+func (store *FileDeviceStore) Update(token string, fn func(device *Device)) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.update(token, fn)
+	return store.flush()
+}
+
+func (store *FileDeviceStore) Delete(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, found := store.devices[token]; !found {
+		return ErrDeviceNotFound
+	}
+
+	delete(store.devices, token)
+	return store.flush()
+}
+
+// Writes every device to disk, the caller holds the lock
+func (store *FileDeviceStore) flush() error {
+	devices := make([]Device, 0, len(store.devices))
+
+	for _, device := range store.devices {
+		devices = append(devices, device)
+	}
+
+	sort.Sort(devicesByToken(devices))
+
+	content, err := json.MarshalIndent(devices, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(store.path, content)
+}
+
+type devicesByToken []Device
+
+func (devices devicesByToken) Len() int           { return len(devices) }
+func (devices devicesByToken) Swap(i, j int)      { devices[i], devices[j] = devices[j], devices[i] }
+func (devices devicesByToken) Less(i, j int) bool { return devices[i].Token < devices[j].Token }
+
+// Stores hand out copies so callers can't modify their state by accident
+func copyDevice(device Device) Device {
+	device.Tags = append([]string(nil), device.Tags...)
+	device.NotificationTypes = append([]string(nil), device.NotificationTypes...)
+
+	if device.Location != nil {
+		location := *device.Location
+		device.Location = &location
+	}
+
+	return device
+}
+
+// MirrorError is reported to PushBots.OnMirrorError when PushBots.Devices
+// could not be updated after a successful API call. The call itself returns
+// nil since it took effect, so it must not be retried.
+type MirrorError struct {
+	Token string // Empty when the devices were addressed by alias
+	Alias string
+	Err   error
+}
+
+func (mirrorError *MirrorError) Error() string {
+	return "Could not update the local device mirror: " + mirrorError.Err.Error()
+}
+
+// Applies update to the mirrored devices after a successful API call,
+// a failure is reported to OnMirrorError instead of failing the call
+func (pushbots *PushBots) mirror(token, platform, alias string, update func(device *Device)) {
+	if err := pushbots.updateDevices(token, platform, alias, update); err != nil {
+		pushbots.mirrorFailed(token, alias, err)
+	}
+}
+
+// Removes a device from the mirror after a successful API call, a failure is reported to OnMirrorError
+func (pushbots *PushBots) forget(token string) {
+	if err := pushbots.removeDevice(token); err != nil {
+		pushbots.mirrorFailed(token, "", err)
+	}
+}
+
+func (pushbots *PushBots) mirrorFailed(token, alias string, err error) {
+	if pushbots.OnMirrorError != nil {
+		pushbots.OnMirrorError(&MirrorError{Token: token, Alias: alias, Err: err})
+	}
+}
+
+// Applies update to the mirrored device.
+// A token addresses a single device, created if it isn't known yet; without
+// a token every known device with the alias on the platform is updated.
+func (pushbots *PushBots) updateDevices(token, platform, alias string, update func(device *Device)) error {
+	if pushbots.Devices == nil {
+		return nil
+	}
+
+	apply := func(device *Device) {
+		if device.Platform == "" {
+			device.Platform, device.Alias = platform, alias
+		}
+
+		update(device)
+		device.Updated = time.Now()
+	}
+
+	if token != "" {
+		return pushbots.Devices.Update(token, apply)
+	}
+
+	byAlias, err := pushbots.Devices.ByAlias(alias)
+
+	if err != nil {
+		return err
+	}
+
+	for _, device := range byAlias {
+		if device.Platform != platform {
+			continue
+		}
+
+		if err := pushbots.Devices.Update(device.Token, apply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes a device from the mirror, unknown devices are ignored
+func (pushbots *PushBots) removeDevice(token string) error {
+	if pushbots.Devices == nil {
+		return nil
+	}
+
+	if err := pushbots.Devices.Delete(token); err != nil && err != ErrDeviceNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Appends value unless it is already present
+func addString(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+
+	return append(values, value)
+}
+
+// Returns values without any occurrence of value
+func removeString(values []string, value string) []string {
+	result := values[:0]
+
+	for _, candidate := range values {
+		if candidate != value {
+			result = append(result, candidate)
+		}
+	}
+
+	return result
+}
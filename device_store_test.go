@@ -0,0 +1,184 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceStoreMirror(t *testing.T) {
+	failing := false
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	path, cleanup := tempPath(t, "devices.json")
+	defer cleanup()
+
+	store, err := NewFileDeviceStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = store
+
+	if err := pushBots.RegisterDevice(token, PlatformIos, lat, lng, []string{notificationType1}, []string{tag1}, alias); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.RegisterDevice("other", PlatformIos, "", "", nil, nil, alias); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.RegisterDevice("android", PlatformAndroid, "", "", nil, nil, alias); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alias only calls update every device with the alias on the platform
+	if err := pushBots.TagDevice("", PlatformIos, alias, tag2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.UnTagDevice(token, PlatformIos, "", tag1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.AddNotificationType(token, PlatformIos, "", notificationType2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.RemoveNotificationType(token, PlatformIos, "", notificationType1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.Badge(token, PlatformIos, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.Geo(token, PlatformIos, "10.5", "20.25"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed calls leave the mirror untouched
+	failing = true
+
+	if err := pushBots.TagDevice(token, PlatformIos, "", "never"); err == nil {
+		t.Fatal("Expected the failing server to return an error")
+	}
+
+	failing = false
+
+	// Reopen the file to make sure the state was persisted
+	store, err = NewFileDeviceStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := store.Get(token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Device{
+		Token:             token,
+		Platform:          PlatformIos,
+		Alias:             alias,
+		Tags:              []string{tag2},
+		NotificationTypes: []string{notificationType2},
+		Badge:             4,
+		Location:          &Coordinates{Lat: 10.5, Lng: 20.25},
+		Updated:           device.Updated,
+	}
+
+	if !reflect.DeepEqual(device, expected) {
+		t.Fatalf("Wrong device state %+v", device)
+	}
+
+	aliased, err := store.ByAlias(alias)
+
+	if err != nil || len(aliased) != 3 {
+		t.Fatal("Expected three aliased devices", aliased, err)
+	}
+
+	for _, device := range aliased {
+		if device.HasTag(tag2) != (device.Platform == PlatformIos) {
+			t.Fatal("Only the aliased iOS devices should have been tagged", device)
+		}
+	}
+
+	pushBots.Devices = store
+
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(token); err != ErrDeviceNotFound {
+		t.Fatal("Unregistered device should be removed, got", err)
+	}
+
+	// Devices first seen through a mutating call are created
+	if err := pushBots.TagDevice("unknown", PlatformAndroid, "", tag1); err != nil {
+		t.Fatal(err)
+	}
+
+	if device, err := store.Get("unknown"); err != nil || device.Platform != PlatformAndroid || !device.HasTag(tag1) {
+		t.Fatal("Unknown device should have been created", device, err)
+	}
+}
+
+// Fails every write, like a full disk
+type failingDeviceStore struct {
+	*MemoryDeviceStore
+}
+
+func (store failingDeviceStore) Save(device Device) error {
+	return errors.New("disk full")
+}
+
+func (store failingDeviceStore) Update(token string, fn func(device *Device)) error {
+	return errors.New("disk full")
+}
+
+func TestDeviceStoreMirrorError(t *testing.T) {
+	requests := 0
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer testServer.Close()
+
+	var mirrorErrors []*MirrorError
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = failingDeviceStore{NewMemoryDeviceStore()}
+	pushBots.OnMirrorError = func(err *MirrorError) { mirrorErrors = append(mirrorErrors, err) }
+
+	// The call took effect, so it must not look like it failed
+	if err := pushBots.TagDevice(token, PlatformIos, "", tag1); err != nil {
+		t.Fatal("A mirror failure should not fail the call", err)
+	}
+
+	if requests != 1 || len(mirrorErrors) != 1 || mirrorErrors[0].Token != token || mirrorErrors[0].Err.Error() != "disk full" {
+		t.Fatal("Expected the mirror failure to be reported", requests, mirrorErrors)
+	}
+
+	if err := pushBots.SetTimeZone(token, PlatformIos, "Europe/Stockholm"); err == nil {
+		t.Fatal("SetTimeZone only updates the mirror, its failure is the result")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeliveryErrors holds the error of every device a delivery failed for, keyed by token
+type DeliveryErrors map[string]error
+
+func (deliveryErrors DeliveryErrors) Error() string {
+	return formatErrorMap("Delivery failed for ", deliveryErrors)
+}
+
+// Records err for every token, or the error of each token when err is DeliveryErrors
+func (deliveryErrors DeliveryErrors) add(tokens []string, err error) {
+	if perToken, ok := err.(DeliveryErrors); ok {
+		for token, tokenErr := range perToken {
+			deliveryErrors[token] = tokenErr
+		}
+	} else if err != nil {
+		for _, token := range tokens {
+			deliveryErrors[token] = err
+		}
+	}
+}
+
+// Formats errors keyed by name as "prefix name: error; name: error" sorted by name
+func formatErrorMap(prefix string, errs map[string]error) string {
+	keys := make([]string, 0, len(errs))
+
+	for key := range errs {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	messages := make([]string, len(keys))
+
+	for i, key := range keys {
+		messages[i] = fmt.Sprintf("%s: %s", key, errs[key])
+	}
+
+	return prefix + strings.Join(messages, "; ")
+}
@@ -0,0 +1,22 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorMapsAreSortedByKey(t *testing.T) {
+	deliveryErrors := DeliveryErrors{"b": errors.New("second"), "a": errors.New("first")}
+
+	if message := deliveryErrors.Error(); message != "Delivery failed for a: first; b: second" {
+		t.Fatal("Wrong message", message)
+	}
+
+	if message := (TagErrors{"news": ErrDeviceNotFound}).Error(); message != "Tag operations failed for news: Device not found" {
+		t.Fatal("Wrong message", message)
+	}
+}
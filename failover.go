@@ -0,0 +1,166 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"sync"
+	"time"
+)
+
+// EndpointStats describes the health and use of one failover endpoint
+type EndpointStats struct {
+	Base                string
+	Served              int64 // Calls answered by this endpoint
+	Failures            int64 // Connection errors and 5xx responses
+	ConsecutiveFailures int
+	Healthy             bool
+	DownUntil           time.Time // Zero when healthy
+}
+
+// Failover sends every call to the first healthy of several base urls, e.g.
+// the PushBots API followed by a relay of your own. Connection errors and 5xx
+// responses move on to the next endpoint; an endpoint failing FailureThreshold
+// times in a row is skipped for CoolDown. When every endpoint is cooling down
+// the one that recovers first is tried anyway.
+//
+// A push may be delivered twice if an endpoint accepted it but still answered
+// with a 5xx. Configure it before use, it is then safe for concurrent use.
+type Failover struct {
+	// Consecutive failures before an endpoint is skipped, defaults to 1
+	FailureThreshold int
+	// How long a failing endpoint is skipped
+	CoolDown time.Duration
+	// Called after every call with the endpoint key and the base that served it, may be nil
+	OnServed func(endpoint, base string)
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+
+	lock      sync.Mutex
+	endpoints []*EndpointStats
+}
+
+// Create a failover over bases in order of preference, each ending with a slash like
+// the argument of ApplyEndpointOverride
+func NewFailover(coolDown time.Duration, bases ...string) *Failover {
+	failover := &Failover{FailureThreshold: 1, CoolDown: coolDown, Now: time.Now}
+
+	for _, base := range bases {
+		failover.endpoints = append(failover.endpoints, &EndpointStats{Base: base, Healthy: true})
+	}
+
+	return failover
+}
+
+// Stats returns a snapshot of every endpoint in order of preference
+func (failover *Failover) Stats() []EndpointStats {
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	now := failover.Now()
+	stats := make([]EndpointStats, len(failover.endpoints))
+
+	for i, endpoint := range failover.endpoints {
+		stats[i] = *endpoint
+		stats[i].Healthy = !endpoint.DownUntil.After(now)
+
+		if stats[i].Healthy {
+			stats[i].DownUntil = time.Time{}
+		}
+	}
+
+	return stats
+}
+
+// Returns the bases to try for the next call
+func (failover *Failover) candidates() []string {
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	now := failover.Now()
+	var bases []string
+	var soonest *EndpointStats
+
+	for _, endpoint := range failover.endpoints {
+		if !endpoint.DownUntil.After(now) {
+			bases = append(bases, endpoint.Base)
+		} else if soonest == nil || endpoint.DownUntil.Before(soonest.DownUntil) {
+			soonest = endpoint
+		}
+	}
+
+	if len(bases) == 0 && soonest != nil {
+		bases = append(bases, soonest.Base)
+	}
+
+	return bases
+}
+
+func (failover *Failover) report(base string, failed bool) {
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	for _, endpoint := range failover.endpoints {
+		if endpoint.Base != base {
+			continue
+		}
+
+		if !failed {
+			endpoint.Served++
+			endpoint.ConsecutiveFailures = 0
+			endpoint.DownUntil = time.Time{}
+			return
+		}
+
+		endpoint.Failures++
+		endpoint.ConsecutiveFailures++
+
+		threshold := failover.FailureThreshold
+
+		if threshold < 1 {
+			threshold = 1
+		}
+
+		if endpoint.ConsecutiveFailures >= threshold {
+			endpoint.DownUntil = failover.Now().Add(failover.CoolDown)
+		}
+
+		return
+	}
+}
+
+// Sends a request through the candidates until one of them answers
+func (failover *Failover) do(endpoint string, pushbotEndpoint pushBotRequest,
+	request func(pushBotRequest) ([]byte, int, error)) ([]byte, int, error) {
+
+	var body []byte
+	var statusCode int
+	var err error
+
+	bases := failover.candidates()
+
+	if len(bases) == 0 {
+		return request(pushbotEndpoint)
+	}
+
+	for _, base := range bases {
+		pushbotEndpoint.Endpoint = base + pushbotEndpoint.Path
+		body, statusCode, err = request(pushbotEndpoint)
+
+		if err != nil || statusCode >= 500 {
+			failover.report(base, true)
+			continue
+		}
+
+		failover.report(base, false)
+
+		if failover.OnServed != nil {
+			failover.OnServed(endpoint, base)
+		}
+
+		break
+	}
+
+	return body, statusCode, err
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	var primaryDown int32 = 1
+	var primaryCalls, secondaryCalls int32
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+
+		if atomic.LoadInt32(&primaryDown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondaryCalls, 1)
+
+		if r.URL.Path != "/push/one" {
+			t.Error("Wrong path on secondary", r.URL.Path)
+		}
+	}))
+	defer secondary.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	var served []string
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.Failover = NewFailover(time.Minute, primary.URL+"/", secondary.URL+"/")
+	pushBots.Failover.Now = func() time.Time { return now }
+	pushBots.Failover.OnServed = func(endpoint, base string) { served = append(served, endpoint+" "+base) }
+
+	send := func() {
+		if err := pushBots.SendPushToDevice(PlatformIos, token, msg, sound, badge, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send()
+
+	if primaryCalls != 1 || secondaryCalls != 1 || served[0] != "pushone "+secondary.URL+"/" {
+		t.Fatal("Expected failover to the secondary", primaryCalls, secondaryCalls, served)
+	}
+
+	// The primary is cooling down and not tried at all
+	send()
+
+	if primaryCalls != 1 || secondaryCalls != 2 {
+		t.Fatal("Primary should be skipped while cooling down", primaryCalls, secondaryCalls)
+	}
+
+	stats := pushBots.Failover.Stats()
+
+	if stats[0].Healthy || stats[0].Failures != 1 || !stats[1].Healthy || stats[1].Served != 2 {
+		t.Fatal("Wrong stats", stats)
+	}
+
+	atomic.StoreInt32(&primaryDown, 0)
+	now = now.Add(time.Minute)
+	send()
+
+	if primaryCalls != 2 || secondaryCalls != 2 {
+		t.Fatal("Primary should be used again after the cool down", primaryCalls, secondaryCalls)
+	}
+
+	if stats := pushBots.Failover.Stats(); !stats[0].Healthy || stats[0].Served != 1 {
+		t.Fatal("Primary should be healthy again", stats)
+	}
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	var calls int32
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.Failover = NewFailover(time.Minute, closed.URL+"/", failing.URL+"/")
+	pushBots.Failover.Now = func() time.Time { return now }
+
+	if err := pushBots.Badge(token, PlatformIos, 1); err == nil {
+		t.Fatal("Expected an error when every endpoint fails")
+	}
+
+	// Both are cooling down, only the one recovering first is tried
+	if err := pushBots.Badge(token, PlatformIos, 1); err == nil || calls != 1 {
+		t.Fatal("Expected a single endpoint to be tried", calls, err)
+	}
+
+	now = now.Add(time.Minute)
+
+	if err := pushBots.Badge(token, PlatformIos, 1); err == nil || calls != 2 {
+		t.Fatal("Expected both endpoints to be tried after the cool down", calls, err)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Run one of them with go test -run '^$' -fuzz FuzzCheckAndReturn, without -fuzz
+// only the seed corpus below is run as part of the normal tests.
+
+func FuzzCheckAndReturn(f *testing.F) {
+	seeds := []string{
+		``,
+		`{"message":"An error"}`,
+		`{"message":""}`,
+		`{"message":null}`,
+		`{"message":{"code":1}}`,
+		`{"message":["a"]}`,
+		`{"message":12}`,
+		`{}`,
+		`null`,
+		`[]`,
+		`"message"`,
+		`<html>Bad gateway</html>`,
+		"\x00\xff",
+		`{"message":"` + strings.Repeat("x", 10000) + `"}`,
+		strings.Repeat("[", 10000),
+	}
+
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		err := checkAndReturn(body, nil)
+
+		if len(body) == 0 {
+			if err != nil {
+				t.Fatal("An empty body is a success", err)
+			}
+
+			return
+		}
+
+		serverError, ok := err.(*ServerError)
+
+		if !ok {
+			t.Fatalf("Every body should be a *ServerError, got %T %v", err, err)
+		}
+
+		if serverError.Message == "" || string(serverError.Body) != string(body) {
+			t.Fatal("ServerError should have a message and the body", serverError)
+		}
+
+		// A server message is used as is, anything else quotes a bounded part of the body
+		var parsed serverErrorResponse
+
+		if json.Unmarshal(body, &parsed) == nil {
+			if message, isString := parsed.Message.(string); isString && message != "" {
+				if serverError.Message != message {
+					t.Fatal("Server message not used", serverError.Message)
+				}
+
+				return
+			}
+		}
+
+		if len(serverError.Message) > maxQuotedBodySize+512 {
+			t.Fatal("Error message should not grow with the body", len(serverError.Message))
+		}
+	})
+}
+
+func FuzzGeneratePlatform(f *testing.F) {
+	for _, platform := range []string{PlatformIos, PlatformAndroid, PlatformAll, "", "2", "ios", "\x00"} {
+		f.Add(platform, true)
+		f.Add(platform, false)
+	}
+
+	f.Fuzz(func(t *testing.T, platform string, asArray bool) {
+		generated, err := generatePlatform(platform, asArray)
+
+		if err != nil {
+			if asArray || platform != PlatformAll {
+				t.Fatal("Only PlatformAll as a single platform should fail", platform, asArray)
+			}
+
+			return
+		}
+
+		if asArray {
+			platforms, ok := generated.([]string)
+
+			if !ok || len(platforms) == 0 {
+				t.Fatalf("Expected a non empty []string, got %#v", generated)
+			}
+		} else if single, ok := generated.(string); !ok || single != platform {
+			t.Fatalf("Expected the platform back, got %#v", generated)
+		}
+	})
+}
+
+// Every request made must be valid JSON carrying the inputs unchanged, any
+// input that is refused must be refused before a request is made.
+func FuzzSendPushToDevice(f *testing.F) {
+	var lock sync.Mutex
+	var received []apiRequest
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var args apiRequest
+
+		if err := json.Unmarshal(body, &args); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lock.Lock()
+		received = append(received, args)
+		lock.Unlock()
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	f.Add(PlatformIos, token, msg, sound, badge, "key", "value")
+	f.Add(PlatformAndroid, "✓ tökén", "Hej på dig 👋", "", "", "", "")
+	f.Add(PlatformAll, token, msg, sound, badge, "a", "b")
+	f.Add(PlatformIos, "", msg, sound, badge, "a", "b")
+	f.Add(PlatformIos, "tok\x00en\n", "line\r\nbreak\t ", "\x7f", "-1", "\"", "<script>")
+	f.Add(PlatformIos, token, strings.Repeat("long message ", 1000), sound, badge, strings.Repeat("k", 1000), strings.Repeat("v", 10000))
+
+	f.Fuzz(func(t *testing.T, platform, deviceToken, message, sound, badge, payloadKey, payloadValue string) {
+		lock.Lock()
+		received = nil
+		lock.Unlock()
+
+		payload := map[string]interface{}{payloadKey: payloadValue}
+		err := pushBots.SendPushToDevice(platform, deviceToken, message, sound, badge, payload)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if err != nil {
+			if _, isServerError := err.(*ServerError); isServerError {
+				t.Fatal("Server should accept every request that is sent", err)
+			}
+
+			if len(received) != 0 {
+				t.Fatal("A refused input should not be sent", err)
+			}
+
+			return
+		}
+
+		if len(received) != 1 {
+			t.Fatal("Expected exactly one request", len(received))
+		}
+
+		// Invalid UTF-8 is replaced when encoded, everything else must survive the round trip
+		args := received[0]
+
+		if utf8.ValidString(deviceToken) && args.Token != deviceToken {
+			t.Fatalf("Token changed: %q", args.Token)
+		}
+
+		if utf8.ValidString(message) && args.Msg != message {
+			t.Fatalf("Message changed: %q", args.Msg)
+		}
+
+		if utf8.ValidString(payloadKey) && utf8.ValidString(payloadValue) && args.Payload[payloadKey] != payloadValue {
+			t.Fatalf("Payload changed: %#v", args.Payload)
+		}
+	})
+}
+
+func FuzzParseCoordinates(f *testing.F) {
+	for _, seed := range [][2]string{{lat, lng}, {"", ""}, {"90", "180"}, {"NaN", "Inf"}, {"1e400", "-0"}, {"0x10", "1_0"}} {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, lat, lng string) {
+		coordinates, err := ParseCoordinates(lat, lng)
+
+		if err != nil {
+			return
+		}
+
+		if coordinates.Validate() != nil {
+			t.Fatal("Parsed coordinates should be valid", coordinates)
+		}
+
+		// Formatting and parsing again gives the same coordinates
+		again, err := ParseCoordinates(formatCoordinate(coordinates.Lat), formatCoordinate(coordinates.Lng))
+
+		if err != nil || again != coordinates {
+			t.Fatal("Coordinates don't survive formatting", coordinates, again, err)
+		}
+	})
+}
+
+func FuzzValidateToken(f *testing.F) {
+	f.Add(PlatformIos, strings.Repeat("ab", 32))
+	f.Add(PlatformAndroid, strings.Repeat("a", 152))
+	f.Add(PlatformAll, "")
+	f.Add(PlatformIos, "\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, platform, deviceToken string) {
+		err := ValidateToken(platform, deviceToken)
+
+		if err != nil {
+			if _, ok := err.(*ValidationError); !ok {
+				t.Fatalf("Expected a *ValidationError, got %T", err)
+			}
+		}
+	})
+}
+
+func FuzzParseCron(f *testing.F) {
+	for _, seed := range []string{"* * * * *", "*/15 9-17 * * 1-5", "0 0 29 2 *", "0 0 31 4 7", "1-0 * * * *", "*/0 * * * *", "", "a b c d e"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, expression string) {
+		// Only checks that nothing panics, Next may be called on anything that parses
+		if schedule, err := ParseCron(expression); err == nil {
+			schedule.Next(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+	})
+}
+
+func FuzzWebhook(f *testing.F) {
+	f.Add(`{"type":"opened","token":"abc"}`)
+	f.Add(`[{"type":"delivered"},{"type":"registered","payload":{"a":[1,2]}}]`)
+	f.Add(`[{"type":""}]`)
+	f.Add(`{"type":"opened","time":"not a time"}`)
+	f.Add(strings.Repeat(`{"type":"opened"},`, 1000))
+
+	webhook := NewWebhookHandler(webhookSecret)
+	webhook.On(EventOpened, func(event Event) {})
+
+	f.Fuzz(func(t *testing.T, body string) {
+		code := postWebhook(webhook, body, map[string]string{WebhookSignatureHeader: SignWebhook(webhookSecret, []byte(body))})
+
+		if code != http.StatusNoContent && code != http.StatusBadRequest && code != http.StatusRequestEntityTooLarge {
+			t.Fatal("Unexpected status", code)
+		}
+	})
+}
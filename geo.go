@@ -0,0 +1,151 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Mean earth radius used for distance calculations
+const earthRadiusKm = 6371.0
+
+// Coordinates is a point on earth expressed in decimal degrees
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// NewCoordinates creates a validated set of coordinates
+func NewCoordinates(lat, lng float64) (Coordinates, error) {
+	coordinates := Coordinates{Lat: lat, Lng: lng}
+	return coordinates, coordinates.Validate()
+}
+
+// ParseCoordinates parses a latitude and longitude given as decimal strings
+func ParseCoordinates(lat, lng string) (Coordinates, error) {
+	if strings.TrimSpace(lat) == "" || strings.TrimSpace(lng) == "" {
+		return Coordinates{}, errors.New("Latitude/Longitude not specified")
+	}
+
+	latValue, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+
+	if err != nil {
+		return Coordinates{}, newValidationError("lat", lat, "Latitude must be a decimal number")
+	}
+
+	lngValue, err := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+
+	if err != nil {
+		return Coordinates{}, newValidationError("lng", lng, "Longitude must be a decimal number")
+	}
+
+	return NewCoordinates(latValue, lngValue)
+}
+
+// Validate checks that latitude is within [-90, 90] and longitude within [-180, 180]
+func (coordinates Coordinates) Validate() error {
+	if math.IsNaN(coordinates.Lat) || coordinates.Lat < -90 || coordinates.Lat > 90 {
+		return newValidationError("lat", formatCoordinate(coordinates.Lat), "Latitude must be between -90 and 90")
+	}
+
+	if math.IsNaN(coordinates.Lng) || coordinates.Lng < -180 || coordinates.Lng > 180 {
+		return newValidationError("lng", formatCoordinate(coordinates.Lng), "Longitude must be between -180 and 180")
+	}
+
+	return nil
+}
+
+// DistanceTo returns the great circle distance in kilometers using the haversine formula
+func (coordinates Coordinates) DistanceTo(other Coordinates) float64 {
+	lat1 := coordinates.Lat * math.Pi / 180
+	lat2 := other.Lat * math.Pi / 180
+	deltaLat := (other.Lat - coordinates.Lat) * math.Pi / 180
+	deltaLng := (other.Lng - coordinates.Lng) * math.Pi / 180
+
+	a := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(deltaLng/2)*math.Sin(deltaLng/2)
+
+	return 2 * earthRadiusKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Formats a coordinate the way PushBots expects it, plain decimal without exponent
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Add geo information to a device using numeric coordinates
+func (pushbots *PushBots) GeoCoordinates(token, platform string, coordinates Coordinates) error {
+	if err := pushbots.checkArgs(token, platform); err != nil {
+		return err
+	}
+
+	if err := coordinates.Validate(); err != nil {
+		return err
+	}
+
+	args := apiRequest{
+		Token:    token,
+		Platform: platform,
+		Lat:      formatCoordinate(coordinates.Lat),
+		Lng:      formatCoordinate(coordinates.Lng),
+	}
+
+	if err := checkAndReturn(pushbots.sendToEndpoint("geos", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, "", func(device *Device) {
+		device.Location = &coordinates
+	})
+
+	return nil
+}
+
+// Push a notification to all devices whose last known location is within radiusKm of center
+func (pushbots *PushBots) GeoPush(platform, msg, sound, badge string, center Coordinates, radiusKm float64,
+	payload map[string]interface{}) error {
+
+	if platform != PlatformIos && platform != PlatformAndroid {
+		return newValidationError("platform", platform, "Platform must be either PlatformIos or PlatformAndroid")
+	}
+
+	if err := center.Validate(); err != nil {
+		return err
+	}
+
+	if math.IsNaN(radiusKm) || radiusKm <= 0 || radiusKm > math.Pi*earthRadiusKm {
+		return newValidationError("radius", formatCoordinate(radiusKm), "Radius must be a positive number of kilometers")
+	}
+
+	if msg == "" {
+		return errors.New("No message specified")
+	}
+
+	if sound == "" && platform != PlatformIos {
+		return errors.New("No sound specified")
+	} else if sound == "" && platform == PlatformIos {
+		sound = "default"
+	}
+
+	if badge == "" {
+		badge = "0"
+	}
+
+	args := apiRequest{
+		Platform: platform,
+		Msg:      msg,
+		Sound:    sound,
+		Badge:    badge,
+		Payload:  payload,
+		Lat:      formatCoordinate(center.Lat),
+		Lng:      formatCoordinate(center.Lng),
+		Radius:   formatCoordinate(radiusKm),
+	}
+
+	return checkAndReturn(pushbots.sendToEndpoint("geopush", args))
+}
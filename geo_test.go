@@ -0,0 +1,200 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A tiny stand in for the PushBots geo features. It remembers the
+// location reported for each token and resolves geo targeted pushes
+// by haversine distance.
+type geoEmulator struct {
+	sync.Mutex
+	locations map[string]Coordinates
+	delivered []string
+}
+
+func newGeoEmulator() *geoEmulator {
+	return &geoEmulator{locations: make(map[string]Coordinates)}
+}
+
+func (emulator *geoEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var args apiRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lat, latErr := strconv.ParseFloat(args.Lat, 64)
+	lng, lngErr := strconv.ParseFloat(args.Lng, 64)
+
+	if latErr != nil || lngErr != nil {
+		http.Error(w, "bad coordinates", http.StatusBadRequest)
+		return
+	}
+
+	emulator.Lock()
+	defer emulator.Unlock()
+
+	switch r.URL.Path {
+	case "/geo":
+		emulator.locations[args.Token] = Coordinates{Lat: lat, Lng: lng}
+	case "/push/all":
+		radius, err := strconv.ParseFloat(args.Radius, 64)
+
+		if err != nil {
+			http.Error(w, "bad radius", http.StatusBadRequest)
+			return
+		}
+
+		center := Coordinates{Lat: lat, Lng: lng}
+
+		for token, location := range emulator.locations {
+			if center.DistanceTo(location) <= radius {
+				emulator.delivered = append(emulator.delivered, token)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestParseCoordinates(t *testing.T) {
+	t.Parallel()
+
+	coordinates, err := ParseCoordinates(lat, lng)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if coordinates.Lat != 59.3333333 || coordinates.Lng != 18.05 {
+		t.Fatal("Coordinates were not parsed correctly", coordinates)
+	}
+
+	invalid := []struct {
+		lat, lng, field string
+	}{
+		{"abc", lng, "lat"},
+		{lat, "abc", "lng"},
+		{"90.5", lng, "lat"},
+		{lat, "200.0", "lng"},
+		{"NaN", lng, "lat"},
+	}
+
+	for _, c := range invalid {
+		_, err := ParseCoordinates(c.lat, c.lng)
+
+		validationErr, ok := err.(*ValidationError)
+
+		if !ok {
+			t.Fatalf("Expected a *ValidationError for %s,%s got %v", c.lat, c.lng, err)
+		}
+
+		if validationErr.Field != c.field {
+			t.Fatalf("Expected field %q, got %q", c.field, validationErr.Field)
+		}
+	}
+
+	if _, err := ParseCoordinates("", lng); err == nil {
+		t.Fatal("Empty latitude should be rejected")
+	}
+}
+
+func TestFormatCoordinate(t *testing.T) {
+	t.Parallel()
+
+	cases := map[float64]string{
+		59.3333333: "59.3333333",
+		-180:       "-180",
+		0.00001:    "0.00001",
+	}
+
+	for value, expected := range cases {
+		if formatted := formatCoordinate(value); formatted != expected {
+			t.Fatalf("Expected %s, got %s", expected, formatted)
+		}
+	}
+}
+
+func TestDistanceTo(t *testing.T) {
+	t.Parallel()
+
+	stockholm := Coordinates{Lat: 59.3293, Lng: 18.0686}
+	gothenburg := Coordinates{Lat: 57.7089, Lng: 11.9746}
+
+	distance := stockholm.DistanceTo(gothenburg)
+
+	if math.Abs(distance-398) > 5 {
+		t.Fatalf("Expected roughly 398km, got %f", distance)
+	}
+
+	if stockholm.DistanceTo(stockholm) != 0 {
+		t.Fatal("Distance to self should be zero")
+	}
+}
+
+func TestRegisterDeviceRejectsInvalidLocation(t *testing.T) {
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride("http://127.0.0.1:0/")
+
+	if err := pushBots.RegisterDevice(token, PlatformIos, "200", lng, nil, nil, ""); err == nil {
+		t.Fatal("Out of range latitude should be rejected")
+	}
+
+	if err := pushBots.RegisterDevice(token, PlatformIos, lat, "", nil, nil, ""); err == nil {
+		t.Fatal("Latitude without longitude should be rejected")
+	}
+}
+
+func TestGeoPush(t *testing.T) {
+	emulator := newGeoEmulator()
+	testServer := httptest.NewServer(emulator)
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	devices := map[string]Coordinates{
+		"stockholm":  {Lat: 59.3293, Lng: 18.0686},
+		"uppsala":    {Lat: 59.8586, Lng: 17.6389},
+		"gothenburg": {Lat: 57.7089, Lng: 11.9746},
+	}
+
+	for deviceToken, location := range devices {
+		if err := pushBots.GeoCoordinates(deviceToken, PlatformIos, location); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := pushBots.GeoPush(PlatformIos, msg, "", "", devices["stockholm"], 100, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(emulator.delivered)
+
+	if len(emulator.delivered) != 2 || emulator.delivered[0] != "stockholm" || emulator.delivered[1] != "uppsala" {
+		t.Fatal("Wrong devices targeted", emulator.delivered)
+	}
+
+	if err := pushBots.GeoPush(PlatformIos, msg, "", "", devices["stockholm"], 0, nil); err == nil {
+		t.Fatal("Zero radius should be rejected")
+	}
+
+	if err := pushBots.GeoPush(PlatformIos, msg, "", "", Coordinates{Lat: 91}, 10, nil); err == nil {
+		t.Fatal("Invalid center should be rejected")
+	}
+}
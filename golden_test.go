@@ -0,0 +1,250 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run go test -run TestGolden -update to rewrite the golden files after an intended wire change
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// Headers added by the Go http client itself rather than by this package
+var ignoredGoldenHeaders = map[string]bool{"Accept-Encoding": true, "User-Agent": true}
+
+// Formats a request as verb, path, headers and body exactly as received
+func formatWireRequest(request recordedRequest) string {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%s %s\n", request.Method, request.URL.RequestURI())
+
+	names := make([]string, 0, len(request.Header))
+
+	for name := range request.Header {
+		if !ignoredGoldenHeaders[name] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "%s: %s\n", name, strings.Join(request.Header[name], ", "))
+	}
+
+	fmt.Fprintf(&buffer, "\n%s\n", request.Body)
+
+	return buffer.String()
+}
+
+type goldenCase struct {
+	name string
+	call func(pushBots *PushBots) error
+	// Requests are made concurrently, so they are compared sorted
+	unordered bool
+}
+
+func goldenCases() []goldenCase {
+	payload := map[string]interface{}{"screen": "offers", "id": 42, "nested": map[string]interface{}{"b": true, "a": nil}}
+	notification := Notification{Platform: PlatformIos, Msg: msg, Sound: sound, Badge: "2", Payload: payload}
+
+	return []goldenCase{
+		{name: "register_device", call: func(pushBots *PushBots) error {
+			return pushBots.RegisterDevice(token, PlatformIos, lat, lng, []string{notificationType1}, []string{tag1, tag2}, alias)
+		}},
+		{name: "register_device_minimal", call: func(pushBots *PushBots) error {
+			return pushBots.RegisterDevice(token, PlatformAndroid, "", "", nil, []string{}, "")
+		}},
+		{name: "register", call: func(pushBots *PushBots) error {
+			return pushBots.Register(Device{Token: token, Platform: PlatformIos, Tags: []string{tag1}, Location: &Coordinates{Lat: -33.8688, Lng: 151.2093}})
+		}},
+		{name: "unregister_device", call: func(pushBots *PushBots) error {
+			return pushBots.UnregisterDevice(token, PlatformAndroid)
+		}},
+		{name: "tag_device", call: func(pushBots *PushBots) error {
+			return pushBots.TagDevice(token, PlatformIos, "", tag1)
+		}},
+		{name: "tag_device_alias", call: func(pushBots *PushBots) error {
+			return pushBots.TagDevice("", PlatformIos, alias, tag1)
+		}},
+		{name: "untag_device", call: func(pushBots *PushBots) error {
+			return pushBots.UnTagDevice(token, PlatformIos, alias, tag1)
+		}},
+		{name: "geo", call: func(pushBots *PushBots) error {
+			return pushBots.Geo(token, PlatformIos, lat, lng)
+		}},
+		{name: "geo_coordinates", call: func(pushBots *PushBots) error {
+			return pushBots.GeoCoordinates(token, PlatformIos, Coordinates{Lat: 0, Lng: -0.1275})
+		}},
+		{name: "geo_push", call: func(pushBots *PushBots) error {
+			return pushBots.GeoPush(PlatformIos, msg, sound, badge, Coordinates{Lat: 59.3333333, Lng: 18.05}, 2.5, payload)
+		}},
+		{name: "add_notification_type", call: func(pushBots *PushBots) error {
+			return pushBots.AddNotificationType(token, PlatformIos, "", notificationType1)
+		}},
+		{name: "remove_notification_type_alias", call: func(pushBots *PushBots) error {
+			return pushBots.RemoveNotificationType("", PlatformAndroid, alias, notificationType1)
+		}},
+		{name: "broadcast", call: func(pushBots *PushBots) error {
+			return pushBots.Broadcast(PlatformAll, msg, sound, badge, payload)
+		}},
+		{name: "broadcast_defaults", call: func(pushBots *PushBots) error {
+			return pushBots.Broadcast(PlatformIos, msg, "", "", nil)
+		}},
+		{name: "send_push_to_device", call: func(pushBots *PushBots) error {
+			return pushBots.SendPushToDevice(PlatformIos, token, "Unicode ✓ \"quoted\" <html> &  ", sound, badge, payload)
+		}},
+		{name: "batch", call: func(pushBots *PushBots) error {
+			return pushBots.Batch(PlatformAndroid, msg, sound, badge, []string{tag1}, []string{tag2},
+				[]string{notificationType1}, []string{notificationType2}, alias, "other", payload)
+		}},
+		{name: "batch_minimal", call: func(pushBots *PushBots) error {
+			return pushBots.Batch(PlatformIos, msg, "", "", nil, nil, nil, nil, "", "", nil)
+		}},
+		{name: "badge_zero", call: func(pushBots *PushBots) error {
+			return pushBots.Badge(token, PlatformIos, 0)
+		}},
+		{name: "badge", call: func(pushBots *PushBots) error {
+			return pushBots.Badge(token, PlatformIos, 7)
+		}},
+		{name: "record_analytics", call: func(pushBots *PushBots) error {
+			return pushBots.RecordAnalytics(token, PlatformIos, "custom")
+		}},
+		{name: "record_event", call: func(pushBots *PushBots) error {
+			return pushBots.RecordEvent(token, PlatformAndroid, AnalyticsOpened)
+		}},
+		{name: "set_alias", call: func(pushBots *PushBots) error {
+			return pushBots.SetAlias(token, PlatformIos, alias)
+		}},
+		{name: "remove_alias", call: func(pushBots *PushBots) error {
+			return pushBots.RemoveAlias(token, PlatformIos, alias)
+		}},
+		{name: "send_push_to_alias", call: func(pushBots *PushBots) error {
+			return pushBots.SendPushToAlias(PlatformIos, alias, msg, sound, badge, payload)
+		}},
+		{name: "badge_alias", call: func(pushBots *PushBots) error {
+			return pushBots.BadgeAlias(alias, PlatformIos, 0)
+		}},
+		{name: "geo_alias", call: func(pushBots *PushBots) error {
+			return pushBots.GeoAlias(alias, PlatformIos, Coordinates{Lat: 1.5, Lng: 2})
+		}},
+		{name: "unregister_alias", call: func(pushBots *PushBots) error {
+			return pushBots.UnregisterAlias(alias, PlatformAndroid)
+		}},
+		{name: "record_analytics_alias", call: func(pushBots *PushBots) error {
+			return pushBots.RecordAnalyticsAlias(alias, PlatformIos, string(AnalyticsOpened))
+		}},
+		{name: "send_notification_token", call: func(pushBots *PushBots) error {
+			return pushBots.SendNotification(notification, Audience{Token: token})
+		}},
+		{name: "send_notification_tokens", call: func(pushBots *PushBots) error {
+			return pushBots.SendNotification(notification, Audience{Tokens: []string{token, "other"}})
+		}},
+		{name: "send_notification_broadcast", call: func(pushBots *PushBots) error {
+			return pushBots.SendNotification(notification, Audience{})
+		}},
+		{name: "send_notification_batch_all_platforms", call: func(pushBots *PushBots) error {
+			all := notification
+			all.Platform = PlatformAll
+
+			return pushBots.SendNotification(all, Audience{Tags: []string{tag1}, ExceptAlias: alias})
+		}},
+		{name: "send_templated_push", call: func(pushBots *PushBots) error {
+			notificationTemplate, err := NewNotificationTemplate(Notification{Platform: PlatformIos, Msg: "Hi {{.Name}}",
+				Sound: sound, Payload: map[string]interface{}{"greeting": "Hello {{.Name}}"}})
+
+			if err != nil {
+				return err
+			}
+
+			return pushBots.SendTemplatedPush(notificationTemplate, TemplateRecipient{Token: token, Data: map[string]interface{}{"Name": "Åsa"}})
+		}},
+		{name: "batch_localized", call: func(pushBots *PushBots) error {
+			catalog := NewCatalog("en")
+			catalog.Add("en", "welcome", "Welcome")
+			catalog.Add("sv", "welcome", "Välkommen")
+
+			return pushBots.BatchLocalized(catalog, "welcome", []string{"en", "sv"}, notification)
+		}},
+		{name: "add_tags", unordered: true, call: func(pushBots *PushBots) error {
+			_, err := pushBots.AddTags(token, PlatformIos, "", []string{tag1, tag2})
+			return err
+		}},
+		{name: "remove_tags", unordered: true, call: func(pushBots *PushBots) error {
+			_, err := pushBots.RemoveTags("", PlatformIos, alias, []string{tag1, tag2})
+			return err
+		}},
+		{name: "campaign", call: func(pushBots *PushBots) error {
+			campaign := NewCampaign(pushBots, "golden", Notification{Platform: PlatformAll, Msg: msg, Sound: sound}, Audience{Tags: []string{tag1}})
+			campaign.Variants = []CampaignVariant{{Name: "sv", Msg: "Hej", Audience: &Audience{Tags: []string{"sv"}}}}
+
+			_, err := campaign.Run()
+			return err
+		}},
+		{name: "credentials_provider", call: func(pushBots *PushBots) error {
+			pushBots.Credentials = StaticCredentials{AppId: "rotatedAppId", Secret: "rotatedSecret"}
+
+			return pushBots.Badge(token, PlatformIos, 1)
+		}},
+	}
+}
+
+func TestGolden(t *testing.T) {
+	for _, goldenCase := range goldenCases() {
+		recorder := newRecordingServer()
+
+		pushBots := NewPushBots(appId, secret, false)
+		pushBots.ApplyEndpointOverride(recorder.URL + "/")
+
+		err := goldenCase.call(&pushBots)
+		recorder.Close()
+
+		if err != nil {
+			t.Fatal(goldenCase.name, err)
+		}
+
+		var requests []string
+
+		for _, request := range recorder.received() {
+			requests = append(requests, formatWireRequest(request))
+		}
+
+		if goldenCase.unordered {
+			sort.Strings(requests)
+		}
+
+		actual := []byte(strings.Join(requests, "---\n"))
+		path := filepath.Join("testdata", "golden", goldenCase.name+".golden")
+
+		if *updateGolden {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			continue
+		}
+
+		expected, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			t.Fatal("Missing golden file, run go test -run TestGolden -update", err)
+		}
+
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("Wire format of %s changed\n--- expected\n%s\n--- actual\n%s", goldenCase.name, expected, actual)
+		}
+	}
+}
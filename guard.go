@@ -0,0 +1,274 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"sync"
+	"time"
+)
+
+// FrequencyCap allows at most Max pushes to a device or alias within Per
+type FrequencyCap struct {
+	Max int
+	Per time.Duration
+}
+
+// Why a Guard did not send a push
+type SuppressionReason string
+
+const (
+	SuppressedDuplicate    SuppressionReason = "duplicate"     // The idempotency key was already used within the dedup window
+	SuppressedFrequencyCap SuppressionReason = "frequency_cap" // The recipient reached one of the frequency caps
+)
+
+// GuardResult tells whether a guarded push was sent or why it was suppressed
+type GuardResult struct {
+	Sent       bool
+	Suppressed SuppressionReason // Empty when the push was sent or failed
+}
+
+// GuardStore keeps the state a Guard needs. Every method must be atomic,
+// several processes sharing a store then share their caps and dedup keys.
+type GuardStore interface {
+	// ClaimKey claims an idempotency key until expires, false if it is already claimed
+	ClaimKey(key string, now, expires time.Time) (bool, error)
+	// ReleaseKey gives up a claimed key so the push can be retried
+	ReleaseKey(key string) error
+	// Reserve records a push to subject at now unless that would exceed any of caps
+	Reserve(subject string, now time.Time, caps []FrequencyCap) (bool, error)
+	// Cancel removes a reservation made at the given time, used when the push failed
+	Cancel(subject string, at time.Time) error
+}
+
+// MemoryGuardStore is a GuardStore for a single process
+type MemoryGuardStore struct {
+	lock  sync.Mutex
+	keys  map[string]time.Time
+	sends map[string][]time.Time
+}
+
+// Create an empty in memory guard store
+func NewMemoryGuardStore() *MemoryGuardStore {
+	return &MemoryGuardStore{keys: make(map[string]time.Time), sends: make(map[string][]time.Time)}
+}
+
+func (store *MemoryGuardStore) ClaimKey(key string, now, expires time.Time) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if claimed, found := store.keys[key]; found && claimed.After(now) {
+		return false, nil
+	}
+
+	store.keys[key] = expires
+
+	// Drop expired keys now and then so the map doesn't grow forever
+	if len(store.keys)%1024 == 0 {
+		for candidate, expiry := range store.keys {
+			if !expiry.After(now) {
+				delete(store.keys, candidate)
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func (store *MemoryGuardStore) ReleaseKey(key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.keys, key)
+	return nil
+}
+
+func (store *MemoryGuardStore) Reserve(subject string, now time.Time, caps []FrequencyCap) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var longest time.Duration
+
+	for _, frequencyCap := range caps {
+		if frequencyCap.Per > longest {
+			longest = frequencyCap.Per
+		}
+	}
+
+	// Forget sends older than the longest window
+	sends := store.sends[subject]
+	kept := sends[:0]
+
+	for _, sent := range sends {
+		if now.Sub(sent) < longest {
+			kept = append(kept, sent)
+		}
+	}
+
+	for _, frequencyCap := range caps {
+		count := 0
+
+		for _, sent := range kept {
+			if now.Sub(sent) < frequencyCap.Per {
+				count++
+			}
+		}
+
+		if count >= frequencyCap.Max {
+			store.sends[subject] = kept
+			return false, nil
+		}
+	}
+
+	store.sends[subject] = append(kept, now)
+
+	return true, nil
+}
+
+func (store *MemoryGuardStore) Cancel(subject string, at time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sends := store.sends[subject]
+
+	for i, sent := range sends {
+		if sent.Equal(at) {
+			store.sends[subject] = append(sends[:i], sends[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Guard sits in front of the push methods to stop accidental spam:
+// pushes with an idempotency key already used within DedupWindow are dropped,
+// and pushes to a device or alias are limited by frequency caps.
+// Pushes that fail are not counted and free their idempotency key again.
+type Guard struct {
+	pushBots *PushBots
+	store    GuardStore
+	caps     []FrequencyCap
+	// How long an idempotency key is remembered, defaults to 24 hours
+	DedupWindow time.Duration
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+}
+
+// Create a guard applying caps to every push to a single device or alias
+func NewGuard(pushBots *PushBots, store GuardStore, caps ...FrequencyCap) *Guard {
+	return &Guard{
+		pushBots:    pushBots,
+		store:       store,
+		caps:        caps,
+		DedupWindow: 24 * time.Hour,
+		Now:         time.Now,
+	}
+}
+
+// Send a push to one device, see PushBots.SendPushToDevice. An empty idempotencyKey disables dedup.
+func (guard *Guard) SendPushToDevice(idempotencyKey, platform, token, msg, sound, badge string,
+	payload map[string]interface{}) (GuardResult, error) {
+
+	return guard.send(idempotencyKey, "token:"+token, func() error {
+		return guard.pushBots.SendPushToDevice(platform, token, msg, sound, badge, payload)
+	})
+}
+
+// Send a push to the devices with an alias, see PushBots.SendPushToAlias
+func (guard *Guard) SendPushToAlias(idempotencyKey, platform, alias, msg, sound, badge string,
+	payload map[string]interface{}) (GuardResult, error) {
+
+	return guard.send(idempotencyKey, "alias:"+alias, func() error {
+		return guard.pushBots.SendPushToAlias(platform, alias, msg, sound, badge, payload)
+	})
+}
+
+// Send a notification to an audience, see PushBots.SendNotification.
+// Frequency caps apply when the audience is a single token or alias only.
+func (guard *Guard) SendNotification(idempotencyKey string, notification Notification, audience Audience) (GuardResult, error) {
+	subject := ""
+
+	if audience.Token != "" {
+		subject = "token:" + audience.Token
+	} else if audience.Alias != "" && (Audience{Alias: audience.Alias}).equal(audience) {
+		subject = "alias:" + audience.Alias
+	}
+
+	return guard.send(idempotencyKey, subject, func() error {
+		return guard.pushBots.SendNotification(notification, audience)
+	})
+}
+
+func (guard *Guard) send(idempotencyKey, subject string, push func() error) (GuardResult, error) {
+	now := guard.Now()
+
+	if idempotencyKey != "" {
+		claimed, err := guard.store.ClaimKey(idempotencyKey, now, now.Add(guard.DedupWindow))
+
+		if err != nil {
+			return GuardResult{}, err
+		}
+
+		if !claimed {
+			return GuardResult{Suppressed: SuppressedDuplicate}, nil
+		}
+	}
+
+	reserved := false
+
+	if subject != "" && len(guard.caps) > 0 {
+		allowed, err := guard.store.Reserve(subject, now, guard.caps)
+
+		if err != nil || !allowed {
+			if idempotencyKey != "" {
+				guard.store.ReleaseKey(idempotencyKey)
+			}
+
+			if err != nil {
+				return GuardResult{}, err
+			}
+
+			return GuardResult{Suppressed: SuppressedFrequencyCap}, nil
+		}
+
+		reserved = true
+	}
+
+	if err := push(); err != nil {
+		if reserved {
+			guard.store.Cancel(subject, now)
+		}
+
+		if idempotencyKey != "" {
+			guard.store.ReleaseKey(idempotencyKey)
+		}
+
+		return GuardResult{}, err
+	}
+
+	return GuardResult{Sent: true}, nil
+}
+
+// Reports whether two audiences address exactly the same devices
+func (audience Audience) equal(other Audience) bool {
+	return audience.Token == other.Token && equalStrings(audience.Tokens, other.Tokens) && audience.Alias == other.Alias &&
+		audience.ExceptAlias == other.ExceptAlias && equalStrings(audience.Tags, other.Tags) && equalStrings(audience.ExceptTags, other.ExceptTags) &&
+		equalStrings(audience.NotificationTypes, other.NotificationTypes) &&
+		equalStrings(audience.ExceptNotificationTypes, other.ExceptNotificationTypes)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
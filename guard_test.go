@@ -0,0 +1,128 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newGuardForTest(serverURL string, now *time.Time, caps ...FrequencyCap) *Guard {
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(serverURL + "/")
+
+	guard := NewGuard(&pushBots, NewMemoryGuardStore(), caps...)
+	guard.DedupWindow = time.Hour
+	guard.Now = func() time.Time { return *now }
+
+	return guard
+}
+
+func TestGuardDedup(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard := newGuardForTest(server.URL, &now)
+
+	result, err := guard.SendPushToDevice("order-1", PlatformIos, token, "first", sound, badge, nil)
+
+	if err != nil || !result.Sent {
+		t.Fatal("First push should be sent", result, err)
+	}
+
+	result, err = guard.SendPushToDevice("order-1", PlatformIos, token, "second", sound, badge, nil)
+
+	if err != nil || result.Sent || result.Suppressed != SuppressedDuplicate {
+		t.Fatal("Repeated key should be suppressed", result, err)
+	}
+
+	// No key means no dedup
+	guard.SendPushToDevice("", PlatformIos, token, "third", sound, badge, nil)
+
+	now = now.Add(time.Hour)
+
+	if result, _ := guard.SendPushToDevice("order-1", PlatformIos, token, "fourth", sound, badge, nil); !result.Sent {
+		t.Fatal("Key should expire after the dedup window", result)
+	}
+
+	if sent := server.sent(); len(sent) != 3 || sent[0] != "first" || sent[1] != "third" || sent[2] != "fourth" {
+		t.Fatal("Wrong pushes sent", sent)
+	}
+}
+
+func TestGuardFrequencyCaps(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard := newGuardForTest(server.URL, &now, FrequencyCap{Max: 2, Per: time.Hour}, FrequencyCap{Max: 3, Per: 24 * time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if result, err := guard.SendPushToDevice("", PlatformIos, token, msg, sound, badge, nil); err != nil || !result.Sent {
+			t.Fatal("Push within caps should be sent", result, err)
+		}
+	}
+
+	result, err := guard.SendPushToDevice("key", PlatformIos, token, msg, sound, badge, nil)
+
+	if err != nil || result.Suppressed != SuppressedFrequencyCap {
+		t.Fatal("Hourly cap should suppress", result, err)
+	}
+
+	// Other recipients have their own caps
+	if result, _ := guard.SendPushToAlias("", PlatformIos, alias, msg, sound, badge, nil); !result.Sent {
+		t.Fatal("Alias should not share the device cap", result)
+	}
+
+	now = now.Add(time.Hour)
+
+	// The key of the capped push was released, so it can be used now
+	if result, _ := guard.SendPushToDevice("key", PlatformIos, token, msg, sound, badge, nil); !result.Sent {
+		t.Fatal("Push should be sent once the hour has passed", result)
+	}
+
+	if result, _ := guard.SendNotification("", Notification{Platform: PlatformIos, Msg: msg}, Audience{Token: token}); result.Suppressed != SuppressedFrequencyCap {
+		t.Fatal("Daily cap should suppress", result)
+	}
+
+	// Audiences other than a single device or alias are not capped
+	for i := 0; i < 5; i++ {
+		if result, _ := guard.SendNotification("", Notification{Platform: PlatformIos, Msg: msg}, Audience{Alias: alias, Tags: []string{tag1}}); !result.Sent {
+			t.Fatal("Batch should not be capped", result)
+		}
+	}
+
+	now = now.Add(24 * time.Hour)
+
+	if result, _ := guard.SendPushToDevice("", PlatformIos, token, msg, sound, badge, nil); !result.Sent {
+		t.Fatal("Push should be sent the next day", result)
+	}
+}
+
+func TestGuardFailedPushIsNotCounted(t *testing.T) {
+	failing := true
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard := newGuardForTest(testServer.URL, &now, FrequencyCap{Max: 1, Per: time.Hour})
+
+	if result, err := guard.SendPushToDevice("key", PlatformIos, token, msg, sound, badge, nil); err == nil || result.Sent {
+		t.Fatal("Expected the push to fail", result)
+	}
+
+	failing = false
+
+	if result, err := guard.SendPushToDevice("key", PlatformIos, token, msg, sound, badge, nil); err != nil || !result.Sent {
+		t.Fatal("Retry of a failed push should be allowed", result, err)
+	}
+}
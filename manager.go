@@ -0,0 +1,182 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AppConfig describes one PushBots app handled by a Manager
+type AppConfig struct {
+	Name     string
+	AppId    string
+	Secret   string
+	Endpoint string // Optional endpoint override, see ApplyEndpointOverride
+}
+
+// ManagerConfig holds the settings shared by every app of a Manager
+type ManagerConfig struct {
+	// Client shared by every app, a client with a default transport is created when nil
+	HttpClient *http.Client
+	// Request budget given to each app, zero means unlimited
+	RequestsPerSecond float64
+	Burst             int
+	Debug             bool
+}
+
+// AppResult is the outcome of sending to one app
+type AppResult struct {
+	App      string
+	Err      error
+	Duration time.Duration
+}
+
+// AppErrors holds the error of every app that failed, keyed by app name
+type AppErrors map[string]error
+
+func (appErrors AppErrors) Error() string {
+	return formatErrorMap("Push failed for ", appErrors)
+}
+
+// Manager holds several named PushBots apps sharing one HTTP client and the
+// same rate limit budget, and routes operations to them by name.
+// It is safe for concurrent use.
+type Manager struct {
+	config ManagerConfig
+	lock   sync.RWMutex
+	apps   map[string]*PushBots
+}
+
+// Create a manager without any apps
+func NewManager(config ManagerConfig) *Manager {
+	if config.HttpClient == nil {
+		config.HttpClient = &http.Client{Transport: http.DefaultTransport}
+	}
+
+	return &Manager{config: config, apps: make(map[string]*PushBots)}
+}
+
+// Add an app, names must be unique
+func (manager *Manager) AddApp(app AppConfig) error {
+	if app.Name == "" {
+		return newValidationError("name", app.Name, "App name needs to be set")
+	}
+
+	if app.AppId == "" || app.Secret == "" {
+		return newValidationError("appid", app.AppId, "Appid and/or secret key not set")
+	}
+
+	pushBots := NewPushBots(app.AppId, app.Secret, manager.config.Debug)
+	pushBots.HttpClient = manager.config.HttpClient
+	pushBots.ApplyEndpointOverride(app.Endpoint)
+
+	if manager.config.RequestsPerSecond > 0 {
+		pushBots.RateLimiter = NewRateLimiter(manager.config.RequestsPerSecond, manager.config.Burst)
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if _, exists := manager.apps[app.Name]; exists {
+		return fmt.Errorf("App %q already exists", app.Name)
+	}
+
+	manager.apps[app.Name] = &pushBots
+
+	return nil
+}
+
+// Remove an app
+func (manager *Manager) RemoveApp(name string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	delete(manager.apps, name)
+}
+
+// App returns the client of a named app, use it for any operation on that app
+func (manager *Manager) App(name string) (*PushBots, error) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	pushBots, found := manager.apps[name]
+
+	if !found {
+		return nil, fmt.Errorf("Unknown app %q", name)
+	}
+
+	return pushBots, nil
+}
+
+// Apps returns the names of every app, sorted
+func (manager *Manager) Apps() []string {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	names := make([]string, 0, len(manager.apps))
+
+	for name := range manager.apps {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Send a notification to an audience of one app
+func (manager *Manager) Send(app string, notification Notification, audience Audience) error {
+	pushBots, err := manager.App(app)
+
+	if err != nil {
+		return err
+	}
+
+	return pushBots.SendNotification(notification, audience)
+}
+
+// Send the same notification to several apps concurrently, nil apps means every app.
+// A result is returned per app, failures are also collected in an AppErrors.
+func (manager *Manager) SendToApps(apps []string, notification Notification, audience Audience) ([]AppResult, error) {
+	if apps == nil {
+		apps = manager.Apps()
+	}
+
+	results := make([]AppResult, len(apps))
+	var wait sync.WaitGroup
+
+	for i, app := range apps {
+		wait.Add(1)
+
+		go func(result *AppResult, app string) {
+			defer wait.Done()
+
+			started := time.Now()
+			result.App = app
+			result.Err = manager.Send(app, notification, audience)
+			result.Duration = time.Since(started)
+		}(&results[i], app)
+	}
+
+	wait.Wait()
+
+	appErrors := make(AppErrors)
+
+	for _, result := range results {
+		if result.Err != nil {
+			appErrors[result.App] = result.Err
+		}
+	}
+
+	if len(appErrors) > 0 {
+		return results, appErrors
+	}
+
+	return results, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	var lock sync.Mutex
+	received := make(map[string]int)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appId := r.Header.Get("x-pushbots-appid")
+
+		if r.Header.Get("x-pushbots-secret") != appId+"-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		received[appId]++
+		lock.Unlock()
+	}))
+	defer testServer.Close()
+
+	sharedClient := &http.Client{}
+	manager := NewManager(ManagerConfig{HttpClient: sharedClient, RequestsPerSecond: 100, Burst: 10})
+
+	for _, name := range []string{"brand-a", "brand-b"} {
+		err := manager.AddApp(AppConfig{Name: name, AppId: name, Secret: name + "-secret", Endpoint: testServer.URL + "/"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager.AddApp(AppConfig{Name: "broken", AppId: "broken", Secret: "wrong", Endpoint: testServer.URL + "/"})
+
+	if err := manager.AddApp(AppConfig{Name: "brand-a", AppId: "x", Secret: "y"}); err == nil {
+		t.Fatal("Duplicate app names should be rejected")
+	}
+
+	if apps := manager.Apps(); !reflect.DeepEqual(apps, []string{"brand-a", "brand-b", "broken"}) {
+		t.Fatal("Wrong apps", apps)
+	}
+
+	app, err := manager.App("brand-a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app.HttpClient != sharedClient || app.RateLimiter == nil {
+		t.Fatal("Apps should share the client and get a rate limiter")
+	}
+
+	if err := app.TagDevice(token, PlatformIos, "", tag1); err != nil {
+		t.Fatal(err)
+	}
+
+	notification := Notification{Platform: PlatformIos, Msg: msg}
+
+	if err := manager.Send("missing", notification, Audience{}); err == nil {
+		t.Fatal("Unknown apps should return an error")
+	}
+
+	results, err := manager.SendToApps(nil, notification, Audience{Token: token})
+
+	appErrors, ok := err.(AppErrors)
+
+	if !ok || len(appErrors) != 1 || appErrors["broken"] == nil {
+		t.Fatal("Expected only the broken app to fail, got", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatal("Expected a result per app", results)
+	}
+
+	if !reflect.DeepEqual(received, map[string]int{"brand-a": 2, "brand-b": 1}) {
+		t.Fatal("Requests were not routed per app", received)
+	}
+
+	manager.RemoveApp("broken")
+
+	if _, err := manager.SendToApps([]string{"brand-b"}, notification, Audience{Token: token}); err != nil {
+		t.Fatal(err)
+	}
+}
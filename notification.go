@@ -0,0 +1,90 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+// Notification holds the content of a push, independent of who receives it
+type Notification struct {
+	Platform string                 `json:"platform"`
+	Msg      string                 `json:"msg"`
+	Sound    string                 `json:"sound,omitempty"`
+	Badge    string                 `json:"badge,omitempty"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+}
+
+// Send a notification to one device
+func (pushbots *PushBots) SendNotificationToDevice(token string, notification Notification) error {
+	return pushbots.SendPushToDevice(notification.Platform, token, notification.Msg, notification.Sound,
+		notification.Badge, notification.Payload)
+}
+
+// Audience describes who should receive a notification.
+// A Token targets a single device and Tokens a list of devices on the platform
+// of the notification, pushed one at a time. Any of the filters results in a Batch and an empty audience is
+// a Broadcast to every device.
+type Audience struct {
+	Token                   string   `json:"token,omitempty"`
+	Tokens                  []string `json:"tokens,omitempty"`
+	Alias                   string   `json:"alias,omitempty"`
+	ExceptAlias             string   `json:"except_alias,omitempty"`
+	Tags                    []string `json:"tags,omitempty"`
+	ExceptTags              []string `json:"except_tags,omitempty"`
+	NotificationTypes       []string `json:"notification_types,omitempty"`
+	ExceptNotificationTypes []string `json:"except_notification_types,omitempty"`
+}
+
+// IsBroadcast reports whether the audience is every device of the app
+func (audience Audience) IsBroadcast() bool {
+	return audience.Token == "" && len(audience.Tokens) == 0 && audience.Alias == "" && audience.ExceptAlias == "" &&
+		len(audience.Tags) == 0 && len(audience.ExceptTags) == 0 &&
+		len(audience.NotificationTypes) == 0 && len(audience.ExceptNotificationTypes) == 0
+}
+
+// Send a notification to an audience using SendPushToDevice, Batch or Broadcast.
+// Batches for PlatformAll are sent once per platform. Failed pushes to
+// Tokens don't stop the others and are returned as DeliveryErrors.
+func (pushbots *PushBots) SendNotification(notification Notification, audience Audience) error {
+	if audience.Token != "" {
+		return pushbots.SendNotificationToDevice(audience.Token, notification)
+	}
+
+	if len(audience.Tokens) > 0 {
+		deliveryErrors := make(DeliveryErrors)
+
+		for _, token := range audience.Tokens {
+			if err := pushbots.SendNotificationToDevice(token, notification); err != nil {
+				deliveryErrors[token] = err
+			}
+		}
+
+		if len(deliveryErrors) > 0 {
+			return deliveryErrors
+		}
+
+		return nil
+	}
+
+	if audience.IsBroadcast() {
+		return pushbots.Broadcast(notification.Platform, notification.Msg, notification.Sound, notification.Badge,
+			notification.Payload)
+	}
+
+	platforms, err := generatePlatform(notification.Platform, true)
+
+	if err != nil {
+		return err
+	}
+
+	for _, platform := range platforms.([]string) {
+		err := pushbots.Batch(platform, notification.Msg, notification.Sound, notification.Badge,
+			audience.Tags, audience.ExceptTags, audience.NotificationTypes, audience.ExceptNotificationTypes,
+			audience.Alias, audience.ExceptAlias, notification.Payload)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
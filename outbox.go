@@ -0,0 +1,465 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by outbox stores when an item id is unknown
+var ErrOutboxItemNotFound = errors.New("Outbox item not found")
+
+// OutboxItem is a notification that has been accepted but not yet delivered
+type OutboxItem struct {
+	Id           string       `json:"id"`
+	Notification Notification `json:"notification"`
+	Audience     Audience     `json:"audience"`
+	Created      time.Time    `json:"created"`
+	Attempts     int          `json:"attempts"`
+	NextAttempt  time.Time    `json:"next_attempt"`
+	LastError    string       `json:"last_error,omitempty"`
+}
+
+// OutboxStore durably holds pending and dead lettered items.
+//
+// A SQL implementation maps naturally onto one table with a status column
+// (pending/dead), an index on (status, next_attempt) for Pending and the
+// notification/audience stored as JSON. Complete deletes the row.
+type OutboxStore interface {
+	// Add stores a new pending item
+	Add(item OutboxItem) error
+	// Pending returns up to limit pending items with NextAttempt at or before now, oldest first
+	Pending(now time.Time, limit int) ([]OutboxItem, error)
+	// Update replaces a pending item, used to record failed attempts
+	Update(item OutboxItem) error
+	// Complete removes a delivered item
+	Complete(id string) error
+	// DeadLetter moves a pending item to the dead letter list
+	DeadLetter(item OutboxItem) error
+	// DeadLetters lists items that permanently failed
+	DeadLetters() ([]OutboxItem, error)
+	// Replay moves a dead lettered item back to pending
+	Replay(id string, now time.Time) error
+}
+
+// A single change to a FileOutboxStore, appended to its journal
+type outboxJournalEntry struct {
+	Op   string     `json:"op"` // add, update, complete, dead or replay
+	Item OutboxItem `json:"item"`
+}
+
+// FileOutboxStore is an embedded OutboxStore keeping an append only journal
+// on disk. Every change is synced before it returns, and the journal is
+// compacted to the live items once it grows well past them.
+type FileOutboxStore struct {
+	lock        sync.Mutex
+	path        string
+	file        *os.File
+	pending     map[string]OutboxItem
+	dead        map[string]OutboxItem
+	entries     int // Entries written to the journal since the last compaction
+	compactSize int
+}
+
+// Open or create a file backed outbox store
+func NewFileOutboxStore(path string) (*FileOutboxStore, error) {
+	store := &FileOutboxStore{
+		path:        path,
+		pending:     make(map[string]OutboxItem),
+		dead:        make(map[string]OutboxItem),
+		compactSize: 1000,
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	// Start every process with a compact journal
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Replays the journal into memory
+func (store *FileOutboxStore) load() error {
+	file, err := os.Open(store.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var corrupt error
+
+	for line := 1; scanner.Scan(); line++ {
+		// A torn final line from a crash mid write is ignored, anything else means lost items
+		if corrupt != nil {
+			return corrupt
+		}
+
+		var entry outboxJournalEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			corrupt = fmt.Errorf("Outbox journal %s is corrupt at line %d: %v", store.path, line, err)
+			continue
+		}
+
+		store.apply(entry)
+	}
+
+	return scanner.Err()
+}
+
+func (store *FileOutboxStore) apply(entry outboxJournalEntry) {
+	switch entry.Op {
+	case "add", "update", "replay":
+		delete(store.dead, entry.Item.Id)
+		store.pending[entry.Item.Id] = entry.Item
+	case "complete":
+		delete(store.pending, entry.Item.Id)
+	case "dead":
+		delete(store.pending, entry.Item.Id)
+		store.dead[entry.Item.Id] = entry.Item
+	}
+}
+
+// Rewrites the journal to only contain live items, the caller holds the lock
+func (store *FileOutboxStore) compact() error {
+	var content []byte
+
+	entries := make([]outboxJournalEntry, 0, len(store.pending)+len(store.dead))
+
+	for _, item := range store.pending {
+		entries = append(entries, outboxJournalEntry{Op: "add", Item: item})
+	}
+
+	for _, item := range store.dead {
+		entries = append(entries, outboxJournalEntry{Op: "dead", Item: item})
+	}
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+
+		if err != nil {
+			return err
+		}
+
+		content = append(content, line...)
+		content = append(content, '\n')
+	}
+
+	if store.file != nil {
+		store.file.Close()
+		store.file = nil
+	}
+
+	if err := writeFileAtomic(store.path, content); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	store.file = file
+	store.entries = 0
+
+	return nil
+}
+
+// Appends an entry to the journal and applies it, the caller holds the lock
+func (store *FileOutboxStore) write(entry outboxJournalEntry) error {
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.file.Write(append(line, '\n')); err != nil {
+		// Don't leave a partial line for the next entries to be appended to
+		store.compact()
+		return err
+	}
+
+	if err := store.file.Sync(); err != nil {
+		store.compact()
+		return err
+	}
+
+	store.apply(entry)
+	store.entries++
+
+	if store.entries > store.compactSize && store.entries > 2*(len(store.pending)+len(store.dead)) {
+		return store.compact()
+	}
+
+	return nil
+}
+
+func (store *FileOutboxStore) Add(item OutboxItem) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.write(outboxJournalEntry{Op: "add", Item: item})
+}
+
+func (store *FileOutboxStore) Pending(now time.Time, limit int) ([]OutboxItem, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var items []OutboxItem
+
+	for _, item := range store.pending {
+		if !item.NextAttempt.After(now) {
+			items = append(items, item)
+		}
+	}
+
+	sort.Sort(outboxItemsByCreated(items))
+
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+
+	return items, nil
+}
+
+func (store *FileOutboxStore) Update(item OutboxItem) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, found := store.pending[item.Id]; !found {
+		return ErrOutboxItemNotFound
+	}
+
+	return store.write(outboxJournalEntry{Op: "update", Item: item})
+}
+
+func (store *FileOutboxStore) Complete(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	item, found := store.pending[id]
+
+	if !found {
+		return ErrOutboxItemNotFound
+	}
+
+	return store.write(outboxJournalEntry{Op: "complete", Item: OutboxItem{Id: item.Id}})
+}
+
+func (store *FileOutboxStore) DeadLetter(item OutboxItem) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, found := store.pending[item.Id]; !found {
+		return ErrOutboxItemNotFound
+	}
+
+	return store.write(outboxJournalEntry{Op: "dead", Item: item})
+}
+
+func (store *FileOutboxStore) DeadLetters() ([]OutboxItem, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	items := make([]OutboxItem, 0, len(store.dead))
+
+	for _, item := range store.dead {
+		items = append(items, item)
+	}
+
+	sort.Sort(outboxItemsByCreated(items))
+
+	return items, nil
+}
+
+func (store *FileOutboxStore) Replay(id string, now time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	item, found := store.dead[id]
+
+	if !found {
+		return ErrOutboxItemNotFound
+	}
+
+	item.Attempts = 0
+	item.NextAttempt = now
+	item.LastError = ""
+
+	return store.write(outboxJournalEntry{Op: "replay", Item: item})
+}
+
+// Close the journal file
+func (store *FileOutboxStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+
+	err := store.file.Close()
+	store.file = nil
+
+	return err
+}
+
+type outboxItemsByCreated []OutboxItem
+
+func (items outboxItemsByCreated) Len() int      { return len(items) }
+func (items outboxItemsByCreated) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+func (items outboxItemsByCreated) Less(i, j int) bool {
+	return items[i].Created.Before(items[j].Created)
+}
+
+// Outbox gives at-least-once delivery of notifications.
+// Enqueue durably stores a notification and returns, a dispatcher sends
+// pending items through PushBots and only removes them once the API call
+// succeeded. A crash between sending and completing means the item is sent
+// again, so receivers may see duplicates but never lose a push.
+type Outbox struct {
+	pushBots *PushBots
+	store    OutboxStore
+	// Attempts before an item is dead lettered, defaults to 5
+	MaxAttempts int
+	// Delay before retrying after the given number of failed attempts, defaults to exponential from one second
+	Backoff func(attempts int) time.Duration
+	// Maximum items sent per Dispatch call, defaults to 100
+	BatchSize int
+	// Called whenever an item is moved to the dead letter list, may be nil
+	OnDeadLetter func(item OutboxItem)
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+
+	dispatchLock sync.Mutex
+	loop         backgroundLoop
+}
+
+// Create an outbox delivering through pushBots and storing items in store
+func NewOutbox(pushBots *PushBots, store OutboxStore) *Outbox {
+	return &Outbox{
+		pushBots:    pushBots,
+		store:       store,
+		MaxAttempts: 5,
+		Backoff:     exponentialBackoff,
+		BatchSize:   100,
+		Now:         time.Now,
+	}
+}
+
+func exponentialBackoff(attempts int) time.Duration {
+	if attempts > 16 {
+		attempts = 16
+	}
+
+	return time.Second << uint(attempts-1)
+}
+
+// Enqueue stores a notification for delivery, once this returns the push will not be lost
+func (outbox *Outbox) Enqueue(notification Notification, audience Audience) (OutboxItem, error) {
+	now := outbox.Now()
+	item := OutboxItem{
+		Id:           newJobId(),
+		Notification: notification,
+		Audience:     audience,
+		Created:      now,
+		NextAttempt:  now,
+	}
+
+	return item, outbox.store.Add(item)
+}
+
+// Dispatch sends every pending item that is due and returns how many were delivered.
+// Validation errors are never retried, other errors are retried with backoff
+// until MaxAttempts is reached and the item is dead lettered.
+func (outbox *Outbox) Dispatch() (int, error) {
+	outbox.dispatchLock.Lock()
+	defer outbox.dispatchLock.Unlock()
+
+	items, err := outbox.store.Pending(outbox.Now(), outbox.BatchSize)
+
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+
+	for _, item := range items {
+		sendErr := outbox.pushBots.SendNotification(item.Notification, item.Audience)
+
+		if sendErr == nil {
+			if err := outbox.store.Complete(item.Id); err != nil {
+				return delivered, err
+			}
+
+			delivered++
+			continue
+		}
+
+		item.Attempts++
+		item.LastError = sendErr.Error()
+
+		_, permanent := sendErr.(*ValidationError)
+
+		if permanent || item.Attempts >= outbox.MaxAttempts {
+			if err := outbox.store.DeadLetter(item); err != nil {
+				return delivered, err
+			}
+
+			if outbox.OnDeadLetter != nil {
+				outbox.OnDeadLetter(item)
+			}
+
+			continue
+		}
+
+		item.NextAttempt = outbox.Now().Add(outbox.Backoff(item.Attempts))
+
+		if err := outbox.store.Update(item); err != nil {
+			return delivered, err
+		}
+	}
+
+	return delivered, nil
+}
+
+// DeadLetters lists items that permanently failed
+func (outbox *Outbox) DeadLetters() ([]OutboxItem, error) {
+	return outbox.store.DeadLetters()
+}
+
+// Replay moves a dead lettered item back to pending with its attempts reset
+func (outbox *Outbox) Replay(id string) error {
+	return outbox.store.Replay(id, outbox.Now())
+}
+
+// Start dispatching in the background every interval, interval must be positive
+func (outbox *Outbox) Start(interval time.Duration) error {
+	return outbox.loop.start(interval, func() { outbox.Dispatch() })
+}
+
+// Stop the background dispatcher and wait for the current pass to finish
+func (outbox *Outbox) Stop() {
+	outbox.loop.stop()
+}
@@ -0,0 +1,225 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newOutboxForTest(t *testing.T, path, serverURL string, now *time.Time) (*Outbox, *FileOutboxStore) {
+	store, err := NewFileOutboxStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(serverURL + "/")
+
+	outbox := NewOutbox(&pushBots, store)
+	outbox.Now = func() time.Time { return *now }
+
+	return outbox, store
+}
+
+func tempPath(t *testing.T, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "pushbots")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	path, cleanup := tempPath(t, "outbox.journal")
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	outbox, store := newOutboxForTest(t, path, server.URL, &now)
+
+	for _, text := range []string{"first", "second"} {
+		if _, err := outbox.Enqueue(Notification{Platform: PlatformIos, Msg: text}, Audience{Token: token}); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(time.Second)
+	}
+
+	// The process dies before dispatching, simulate a torn write as well
+	store.Close()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"op":"add","item":{"id":`)
+	file.Close()
+
+	outbox, store = newOutboxForTest(t, path, server.URL, &now)
+	defer store.Close()
+
+	if delivered, err := outbox.Dispatch(); err != nil || delivered != 2 {
+		t.Fatal("Expected both items to be delivered after restart", delivered, err)
+	}
+
+	if messages := server.sent(); len(messages) != 2 || messages[0] != "first" || messages[1] != "second" {
+		t.Fatal("Wrong messages sent", messages)
+	}
+
+	if pending, _ := store.Pending(now, 0); len(pending) != 0 {
+		t.Fatal("Delivered items should be removed", pending)
+	}
+
+	if err := outbox.Start(-time.Second); err == nil {
+		t.Fatal("Start should refuse an interval that isn't positive")
+	}
+}
+
+func TestOutboxRetryAndDeadLetter(t *testing.T) {
+	var failing int32 = 1
+	var requests int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer testServer.Close()
+
+	path, cleanup := tempPath(t, "outbox.journal")
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	outbox, store := newOutboxForTest(t, path, testServer.URL, &now)
+	defer store.Close()
+
+	outbox.MaxAttempts = 3
+	deadLettered := 0
+	outbox.OnDeadLetter = func(item OutboxItem) { deadLettered++ }
+
+	item, err := outbox.Enqueue(Notification{Platform: PlatformIos, Msg: msg}, Audience{Token: token})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid notifications are dead lettered straight away
+	if _, err := outbox.Enqueue(Notification{Platform: "8", Msg: msg}, Audience{Token: token}); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox.Dispatch()
+
+	if deadLettered != 1 {
+		t.Fatal("Validation errors should not be retried")
+	}
+
+	// Not due again until the backoff has passed
+	outbox.Dispatch()
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("Item should wait for its backoff", requests)
+	}
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		outbox.Dispatch()
+	}
+
+	deadLetters, err := outbox.DeadLetters()
+
+	if err != nil || len(deadLetters) != 2 || deadLettered != 2 {
+		t.Fatal("Expected both items to be dead lettered", deadLetters, err)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+
+	if err := outbox.Replay(item.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered, _ := outbox.Dispatch(); delivered != 1 {
+		t.Fatal("Replayed item should be delivered")
+	}
+
+	if deadLetters, _ := outbox.DeadLetters(); len(deadLetters) != 1 {
+		t.Fatal("Only the invalid item should remain dead lettered", deadLetters)
+	}
+
+	if err := outbox.Replay(item.Id); err != ErrOutboxItemNotFound {
+		t.Fatal("Expected ErrOutboxItemNotFound, got", err)
+	}
+}
+
+func TestFileOutboxStoreCorruptJournal(t *testing.T) {
+	path, cleanup := tempPath(t, "outbox.journal")
+	defer cleanup()
+
+	journal := `{"op":"add","item":{"id":"first"}}` + "\n" + `{"op":"add","item":{"id":` + "\n" +
+		`{"op":"add","item":{"id":"second"}}` + "\n"
+
+	if err := ioutil.WriteFile(path, []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileOutboxStore(path); err == nil {
+		t.Fatal("A corrupt line before the last one should fail loading")
+	}
+
+	if content, _ := ioutil.ReadFile(path); string(content) != journal {
+		t.Fatal("A corrupt journal should be left as it is")
+	}
+}
+
+func TestFileOutboxStoreCompaction(t *testing.T) {
+	path, cleanup := tempPath(t, "outbox.journal")
+	defer cleanup()
+
+	store, err := NewFileOutboxStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.compactSize = 10
+	now := time.Now()
+
+	for i := 0; i < 50; i++ {
+		item := OutboxItem{Id: newJobId(), Created: now, NextAttempt: now}
+		store.Add(item)
+		store.Complete(item.Id)
+	}
+
+	store.Add(OutboxItem{Id: "kept", Created: now, NextAttempt: now})
+	store.Close()
+
+	content, _ := ioutil.ReadFile(path)
+
+	if len(content) > 4096 {
+		t.Fatal("Journal was not compacted", len(content))
+	}
+
+	store, err = NewFileOutboxStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	if pending, _ := store.Pending(now, 0); len(pending) != 1 || pending[0].Id != "kept" {
+		t.Fatal("Wrong items after compaction", pending)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers larger than this are left to the garbage collector instead of being pooled
+const maxPooledPayloadSize = 64 << 10
+
+// Payloads requests are encoded into, shared by every PushBots
+var payloadPool = sync.Pool{New: func() interface{} { return new(requestPayload) }}
+
+// An encoded request shared by every attempt at sending it. The http client
+// may still be reading a request body after Do returns, so the buffer only goes
+// back to the pool once the sender and every body have released it.
+type requestPayload struct {
+	buffer bytes.Buffer
+	refs   int32
+}
+
+// A request body reading a payload, releasing it when closed
+type payloadBody struct {
+	bytes.Reader
+	payload *requestPayload
+	once    sync.Once
+}
+
+// Encodes args into a pooled buffer, the payload must be released when done
+func encodePayload(args apiRequest) (*requestPayload, error) {
+	payload := payloadPool.Get().(*requestPayload)
+	payload.buffer.Reset()
+	payload.refs = 1
+
+	if err := json.NewEncoder(&payload.buffer).Encode(args); err != nil {
+		payloadPool.Put(payload)
+		return nil, err
+	}
+
+	// Encode ends with a newline json.Marshal doesn't add, keep the bodies the same
+	payload.buffer.Truncate(payload.buffer.Len() - 1)
+
+	return payload, nil
+}
+
+// Bytes returns the encoded request, valid until the payload is released
+func (payload *requestPayload) Bytes() []byte {
+	return payload.buffer.Bytes()
+}
+
+// Returns a new request body reading the payload, it must be closed
+func (payload *requestPayload) body() io.ReadCloser {
+	atomic.AddInt32(&payload.refs, 1)
+
+	body := &payloadBody{payload: payload}
+	body.Reset(payload.buffer.Bytes())
+
+	return body
+}
+
+func (payload *requestPayload) release() {
+	if atomic.AddInt32(&payload.refs, -1) == 0 && payload.buffer.Cap() <= maxPooledPayloadSize {
+		payloadPool.Put(payload)
+	}
+}
+
+func (body *payloadBody) Close() error {
+	body.once.Do(body.payload.release)
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Provider is a push backend. It only uses Device, Notification and Audience
+// so code written against it doesn't depend on PushBots and its wire format.
+// *PushBots is a Provider, LogProvider and FanOutProvider are others.
+type Provider interface {
+	Register(device Device) error
+	UnregisterDevice(token, platform string) error
+	TagDevice(token, platform, alias, tag string) error
+	UnTagDevice(token, platform, alias, tag string) error
+	SendNotificationToDevice(token string, notification Notification) error
+	SendNotification(notification Notification, audience Audience) error
+}
+
+var _ Provider = (*PushBots)(nil)
+
+// Register a device described by a Device, see RegisterDevice.
+// A time zone is only recorded in the device store.
+func (pushbots *PushBots) Register(device Device) error {
+	var lat, lng string
+
+	if device.Location != nil {
+		lat, lng = formatCoordinate(device.Location.Lat), formatCoordinate(device.Location.Lng)
+	}
+
+	err := pushbots.RegisterDevice(device.Token, device.Platform, lat, lng, device.NotificationTypes, device.Tags,
+		device.Alias)
+
+	if err != nil || device.TimeZone == "" {
+		return err
+	}
+
+	pushbots.mirror(device.Token, device.Platform, device.Alias, func(mirrored *Device) {
+		mirrored.TimeZone = device.TimeZone
+	})
+
+	return nil
+}
+
+// LogEntry is one call recorded by a LogProvider
+type LogEntry struct {
+	Time         time.Time     `json:"time"`
+	Operation    string        `json:"operation"`
+	Token        string        `json:"token,omitempty"`
+	Platform     string        `json:"platform,omitempty"`
+	Alias        string        `json:"alias,omitempty"`
+	Tag          string        `json:"tag,omitempty"`
+	Device       *Device       `json:"device,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Audience     *Audience     `json:"audience,omitempty"`
+}
+
+// LogProvider writes every call as a line of JSON instead of sending it anywhere.
+// Useful in development, as a dry run, or next to a real backend in a FanOutProvider.
+type LogProvider struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closer io.Closer
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+}
+
+// Create a provider logging to writer
+func NewLogProvider(writer io.Writer) *LogProvider {
+	return &LogProvider{writer: writer, Now: time.Now}
+}
+
+// Create a provider appending to the file at path, call Close when done
+func NewFileLogProvider(path string) (*LogProvider, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	logProvider := NewLogProvider(file)
+	logProvider.closer = file
+
+	return logProvider, nil
+}
+
+// Close closes the file of a provider made by NewFileLogProvider
+func (logProvider *LogProvider) Close() error {
+	if logProvider.closer == nil {
+		return nil
+	}
+
+	return logProvider.closer.Close()
+}
+
+func (logProvider *LogProvider) Register(device Device) error {
+	return logProvider.log(LogEntry{Operation: "register", Token: device.Token, Platform: device.Platform, Device: &device})
+}
+
+func (logProvider *LogProvider) UnregisterDevice(token, platform string) error {
+	return logProvider.log(LogEntry{Operation: "unregister", Token: token, Platform: platform})
+}
+
+func (logProvider *LogProvider) TagDevice(token, platform, alias, tag string) error {
+	return logProvider.log(LogEntry{Operation: "tag", Token: token, Platform: platform, Alias: alias, Tag: tag})
+}
+
+func (logProvider *LogProvider) UnTagDevice(token, platform, alias, tag string) error {
+	return logProvider.log(LogEntry{Operation: "untag", Token: token, Platform: platform, Alias: alias, Tag: tag})
+}
+
+func (logProvider *LogProvider) SendNotificationToDevice(token string, notification Notification) error {
+	return logProvider.log(LogEntry{Operation: "send", Token: token, Platform: notification.Platform,
+		Notification: &notification})
+}
+
+func (logProvider *LogProvider) SendNotification(notification Notification, audience Audience) error {
+	return logProvider.log(LogEntry{Operation: "send", Platform: notification.Platform, Notification: &notification,
+		Audience: &audience})
+}
+
+func (logProvider *LogProvider) log(entry LogEntry) error {
+	entry.Time = logProvider.Now()
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	logProvider.lock.Lock()
+	defer logProvider.lock.Unlock()
+
+	_, err = logProvider.writer.Write(append(line, '\n'))
+
+	return err
+}
+
+// ProviderResult is the outcome of a call on one provider of a FanOutProvider
+type ProviderResult struct {
+	Provider string
+	Err      error
+	Duration time.Duration
+}
+
+// ProviderErrors holds the error of every provider that failed, keyed by provider name
+type ProviderErrors map[string]error
+
+func (providerErrors ProviderErrors) Error() string {
+	return formatErrorMap("Call failed for ", providerErrors)
+}
+
+// FanOutProvider makes every call on several named providers concurrently.
+// Its Provider methods fail with ProviderErrors when any provider fails, use
+// Each for the result of every provider. Add providers before using it.
+type FanOutProvider struct {
+	names     []string
+	providers []Provider
+}
+
+// Create a fan out without any providers
+func NewFanOutProvider() *FanOutProvider {
+	return &FanOutProvider{}
+}
+
+// Add a provider, names must be unique
+func (fanOut *FanOutProvider) Add(name string, provider Provider) error {
+	if name == "" {
+		return newValidationError("name", name, "Provider name needs to be set")
+	}
+
+	if containsString(fanOut.names, name) {
+		return fmt.Errorf("Provider %q already exists", name)
+	}
+
+	fanOut.names = append(fanOut.names, name)
+	fanOut.providers = append(fanOut.providers, provider)
+
+	return nil
+}
+
+// Each runs call on every provider concurrently, returning a result per
+// provider in the order they were added. Failures are also collected in a ProviderErrors.
+func (fanOut *FanOutProvider) Each(call func(provider Provider) error) ([]ProviderResult, error) {
+	results := make([]ProviderResult, len(fanOut.providers))
+
+	var wait sync.WaitGroup
+
+	for i, provider := range fanOut.providers {
+		wait.Add(1)
+
+		go func(result *ProviderResult, name string, provider Provider) {
+			defer wait.Done()
+
+			started := time.Now()
+			result.Provider = name
+			result.Err = call(provider)
+			result.Duration = time.Since(started)
+		}(&results[i], fanOut.names[i], provider)
+	}
+
+	wait.Wait()
+
+	providerErrors := make(ProviderErrors)
+
+	for _, result := range results {
+		if result.Err != nil {
+			providerErrors[result.Provider] = result.Err
+		}
+	}
+
+	if len(providerErrors) > 0 {
+		return results, providerErrors
+	}
+
+	return results, nil
+}
+
+func (fanOut *FanOutProvider) Register(device Device) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.Register(device)
+	})
+
+	return err
+}
+
+func (fanOut *FanOutProvider) UnregisterDevice(token, platform string) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.UnregisterDevice(token, platform)
+	})
+
+	return err
+}
+
+func (fanOut *FanOutProvider) TagDevice(token, platform, alias, tag string) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.TagDevice(token, platform, alias, tag)
+	})
+
+	return err
+}
+
+func (fanOut *FanOutProvider) UnTagDevice(token, platform, alias, tag string) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.UnTagDevice(token, platform, alias, tag)
+	})
+
+	return err
+}
+
+func (fanOut *FanOutProvider) SendNotificationToDevice(token string, notification Notification) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.SendNotificationToDevice(token, notification)
+	})
+
+	return err
+}
+
+func (fanOut *FanOutProvider) SendNotification(notification Notification, audience Audience) error {
+	_, err := fanOut.Each(func(provider Provider) error {
+		return provider.SendNotification(notification, audience)
+	})
+
+	return err
+}
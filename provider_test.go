@@ -0,0 +1,149 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPushBotsRegisterDevice(t *testing.T) {
+	var received apiRequest
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+
+	var provider Provider = &pushBots
+
+	err := provider.Register(Device{Token: token, Platform: PlatformIos, Alias: alias, Tags: []string{tag1},
+		Location: &Coordinates{Lat: 59.33, Lng: 18.06}, TimeZone: "Europe/Stockholm"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Token != token || received.Lat != "59.33" || received.Lng != "18.06" || received.Alias != alias {
+		t.Fatal("Wrong request", received)
+	}
+
+	if device, _ := pushBots.Devices.Get(token); device.TimeZone != "Europe/Stockholm" {
+		t.Fatal("Time zone should be mirrored", device)
+	}
+}
+
+func TestLogProvider(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logProvider := NewLogProvider(&buffer)
+	logProvider.Now = func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	logProvider.Register(Device{Token: token, Platform: PlatformIos})
+	logProvider.TagDevice(token, PlatformIos, "", tag1)
+	logProvider.SendNotification(Notification{Platform: PlatformIos, Msg: msg}, Audience{Tags: []string{tag1}})
+
+	var operations []string
+	scanner := bufio.NewScanner(&buffer)
+
+	for scanner.Scan() {
+		var entry LogEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		operations = append(operations, entry.Operation)
+
+		if entry.Operation == "send" && (entry.Notification.Msg != msg || entry.Audience.Tags[0] != tag1) {
+			t.Fatal("Send not logged completely", entry)
+		}
+	}
+
+	if len(operations) != 3 || operations[0] != "register" || operations[1] != "tag" || operations[2] != "send" {
+		t.Fatal("Wrong operations logged", operations)
+	}
+}
+
+func TestFileLogProvider(t *testing.T) {
+	path, cleanup := tempPath(t, "pushes.log")
+	defer cleanup()
+
+	logProvider, err := NewFileLogProvider(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logProvider.UnregisterDevice(token, PlatformIos)
+	logProvider.Close()
+
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil || !bytes.Contains(content, []byte(`"operation":"unregister"`)) {
+		t.Fatal("Call not written to file", string(content), err)
+	}
+}
+
+func TestFanOutProvider(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	working := newRecordingServer()
+	defer working.Close()
+
+	primary := NewPushBots(appId, secret, false)
+	primary.ApplyEndpointOverride(working.URL + "/")
+
+	secondary := NewPushBots(appId, secret, false)
+	secondary.ApplyEndpointOverride(failing.URL + "/")
+
+	var buffer bytes.Buffer
+
+	fanOut := NewFanOutProvider()
+	fanOut.Add("primary", &primary)
+	fanOut.Add("secondary", &secondary)
+	fanOut.Add("log", NewLogProvider(&buffer))
+
+	if err := fanOut.Add("log", NewLogProvider(&buffer)); err == nil {
+		t.Fatal("Duplicate name should fail")
+	}
+
+	results, err := fanOut.Each(func(provider Provider) error {
+		return provider.SendNotificationToDevice(token, Notification{Platform: PlatformIos, Msg: msg, Sound: sound})
+	})
+
+	providerErrors, ok := err.(ProviderErrors)
+
+	if !ok || len(providerErrors) != 1 || providerErrors["secondary"] == nil {
+		t.Fatal("Only secondary should fail", err)
+	}
+
+	if len(results) != 3 || results[0].Provider != "primary" || results[0].Err != nil || results[2].Provider != "log" {
+		t.Fatal("Wrong results", results)
+	}
+
+	if sent := working.sent(); len(sent) != 1 || sent[0] != msg {
+		t.Fatal("Primary should have sent", sent)
+	}
+
+	if buffer.Len() == 0 {
+		t.Fatal("Log provider should have been called")
+	}
+
+	var _ Provider = fanOut
+}
@@ -12,9 +12,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
 // Constants for the different platforms supported
@@ -29,18 +29,47 @@ const (
 	productionEndPoint = "https://api.pushbots.com/"
 )
 
+// Largest response body read when PushBots.MaxResponseSize is not set
+const DefaultMaxResponseSize = 1 << 20
+
+// Returned when a response body is larger than PushBots.MaxResponseSize, nothing more of it is read
+var ErrResponseTooLarge = errors.New("Response from server is larger than the maximum response size")
+
 // Simply holds an endpoint and what http verb to use when connecting to that endpoint
 type pushBotRequest struct {
 	Endpoint string
 	HttpVerb string
+	Path     string // Endpoint relative to the base, used to build it for other bases
 }
 
-// Holds the appid and app secret for use in requests
+// Holds the appid and app secret for use in requests.
+//
+// A PushBots is safe for concurrent use by multiple goroutines once it has been
+// configured: set its fields and call ApplyEndpointOverride before sharing it,
+// after that nothing in it is modified by any method.
 type PushBots struct {
-	AppId     string
-	Secret    string
-	Debug     bool
-	endpoints map[string]pushBotRequest
+	AppId  string
+	Secret string
+	Debug  bool
+	// When set device tokens are checked with ValidateToken before any request is made
+	StrictTokenValidation bool
+	// Optional local mirror updated after every successful call changing a device
+	Devices DeviceStore
+	// Called when Devices could not be updated after a successful call, which still returns nil. May be nil.
+	OnMirrorError func(err *MirrorError)
+	// Client used for requests, a new default client is used when nil
+	HttpClient *http.Client
+	// Optional limiter every request waits on before it is sent
+	RateLimiter *RateLimiter
+	// When set it is asked for credentials on every request instead of using AppId and Secret
+	Credentials CredentialsProvider
+	// Optional list of base urls tried in turn, replaces the base set by ApplyEndpointOverride
+	Failover *Failover
+	// Optional circuit breaker failing calls right away while an endpoint is down
+	CircuitBreaker *CircuitBreaker
+	// Largest response body read in bytes, DefaultMaxResponseSize when zero
+	MaxResponseSize int64
+	endpoints       map[string]pushBotRequest
 }
 
 // Used to store the response from the message instead of manually dealing with types
@@ -48,6 +77,30 @@ type serverErrorResponse struct {
 	Message interface{} `json:"message"`
 }
 
+// Longest part of a response body quoted in a ServerError message
+const maxQuotedBodySize = 512
+
+// ServerError is returned when the server answers with an error status or any
+// body at all, which PushBots only sends when something went wrong.
+type ServerError struct {
+	StatusCode int    // Zero when the status was fine but a body was returned
+	Message    string // The message sent by PushBots, or a description of what was received
+	Body       []byte
+}
+
+func (serverError *ServerError) Error() string {
+	return serverError.Message
+}
+
+// Returns body as a string short enough to be part of an error message
+func quoteBody(body []byte) string {
+	if len(body) > maxQuotedBodySize {
+		return fmt.Sprintf("%s... (%d bytes)", body[:maxQuotedBodySize], len(body))
+	}
+
+	return string(body)
+}
+
 // A struct to contain all arguments for a request
 type apiRequest struct {
 	Payload                 map[string]interface{} `json:"payload,omitempty"`
@@ -60,6 +113,7 @@ type apiRequest struct {
 	Tag                     string                 `json:"tag,omitempty"`
 	Lat                     string                 `json:"lat,omitempty"`
 	Lng                     string                 `json:"lng,omitempty"`
+	Radius                  string                 `json:"radius,omitempty"`
 	Msg                     string                 `json:"msg,omitempty"`
 	NotificationType        interface{}            `json:"active,omitempty"` // Sometimes string sometimes []string
 	Stats                   string                 `json:"stats,omitempty"`
@@ -69,68 +123,116 @@ type apiRequest struct {
 	BadgeCount              *int                   `json:"setbadgecount,omitempty"` //Hack to avoid badgecount being omitted if it's value is 0
 }
 
+// Endpoints used by clients that were not created with NewPushBots
+var defaultEndpoints = buildEndpoints("")
+
 // Create a new pushbots object
 func NewPushBots(appId string, secret string, debug bool) PushBots {
 	pushBots := PushBots{AppId: appId, Secret: secret, Debug: debug}
+	pushBots.initializeEndpoints("")
 	return pushBots
 }
 
-// Override the base endpoint used to construct the API urls
+// Override the base endpoint used to construct the API urls.
+// Like any other configuration it must be done before the client is used concurrently.
 func (pushBots *PushBots) ApplyEndpointOverride(endpointOverride string) {
 	pushBots.initializeEndpoints(endpointOverride)
 }
 
 // Initializes all known endpoints
 func (pushBots *PushBots) initializeEndpoints(endpointOverride string) {
+	pushBots.endpoints = buildEndpoints(endpointOverride)
+}
+
+// Builds the map of all known endpoints, the map is never modified afterwards
+func buildEndpoints(endpointOverride string) map[string]pushBotRequest {
 	endpointBase := productionEndPoint
 
 	if endpointOverride != "" {
 		endpointBase = endpointOverride
 	}
 
-	pushBots.endpoints = map[string]pushBotRequest{
-		"registerdevice":         pushBotRequest{Endpoint: endpointBase + "deviceToken", HttpVerb: "PUT"},
-		"unregisterdevice":       pushBotRequest{Endpoint: endpointBase + "deviceToken/del", HttpVerb: "PUT"},
-		"alias":                  pushBotRequest{Endpoint: endpointBase + "alias", HttpVerb: "PUT"},
-		"tagdevice":              pushBotRequest{Endpoint: endpointBase + "tag", HttpVerb: "PUT"},
-		"untagdevice":            pushBotRequest{Endpoint: endpointBase + "tag/del", HttpVerb: "PUT"},
-		"geos":                   pushBotRequest{Endpoint: endpointBase + "geo", HttpVerb: "PUT"},
-		"addnotificationtype":    pushBotRequest{Endpoint: endpointBase + "activate", HttpVerb: "PUT"},
-		"removenotificationtype": pushBotRequest{Endpoint: endpointBase + "deactivate", HttpVerb: "PUT"},
-		"broadcast":              pushBotRequest{Endpoint: endpointBase + "push/all", HttpVerb: "POST"},
-		"pushone":                pushBotRequest{Endpoint: endpointBase + "push/one", HttpVerb: "POST"},
-		"batch":                  pushBotRequest{Endpoint: endpointBase + "push/all", HttpVerb: "POST"},
-		"badge":                  pushBotRequest{Endpoint: endpointBase + "badge", HttpVerb: "PUT"},
-		"recordanalytics":        pushBotRequest{Endpoint: endpointBase + "stats", HttpVerb: "PUT"},
+	endpoints := map[string]pushBotRequest{
+		"registerdevice":         {HttpVerb: "PUT", Path: "deviceToken"},
+		"unregisterdevice":       {HttpVerb: "PUT", Path: "deviceToken/del"},
+		"alias":                  {HttpVerb: "PUT", Path: "alias"},
+		"removealias":            {HttpVerb: "PUT", Path: "alias/del"},
+		"tagdevice":              {HttpVerb: "PUT", Path: "tag"},
+		"untagdevice":            {HttpVerb: "PUT", Path: "tag/del"},
+		"geos":                   {HttpVerb: "PUT", Path: "geo"},
+		"addnotificationtype":    {HttpVerb: "PUT", Path: "activate"},
+		"removenotificationtype": {HttpVerb: "PUT", Path: "deactivate"},
+		"broadcast":              {HttpVerb: "POST", Path: "push/all"},
+		"pushone":                {HttpVerb: "POST", Path: "push/one"},
+		"batch":                  {HttpVerb: "POST", Path: "push/all"},
+		"geopush":                {HttpVerb: "POST", Path: "push/all"},
+		"badge":                  {HttpVerb: "PUT", Path: "badge"},
+		"recordanalytics":        {HttpVerb: "PUT", Path: "stats"},
+	}
+
+	for key, endpoint := range endpoints {
+		endpoint.Endpoint = endpointBase + endpoint.Path
+		endpoints[key] = endpoint
 	}
+
+	return endpoints
 }
 
 // Register a device with PushBots
 func (pushbots *PushBots) RegisterDevice(token, platform, lat, lng string, notificationTypes, tags []string, alias string) error {
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
 	args := apiRequest{
 		Token:    token,
 		Platform: platform,
-		Lat:      lat,
-		Lng:      lng,
 		Tags:     tags,
 		Alias:    alias,
 	}
 
+	// Location is optional when registering, but has to be valid if given
+	if lat != "" || lng != "" {
+		coordinates, err := ParseCoordinates(lat, lng)
+
+		if err != nil {
+			return err
+		}
+
+		args.Lat = formatCoordinate(coordinates.Lat)
+		args.Lng = formatCoordinate(coordinates.Lng)
+	}
+
 	if notificationTypes != nil && len(notificationTypes) > 0 {
 		args.NotificationType = notificationTypes
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("registerdevice", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("registerdevice", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.Platform = platform
+		device.Tags = append([]string(nil), tags...)
+		device.NotificationTypes = append([]string(nil), notificationTypes...)
+
+		if alias != "" {
+			device.Alias = alias
+		}
+
+		if args.Lat != "" {
+			coordinates, _ := ParseCoordinates(args.Lat, args.Lng)
+			device.Location = &coordinates
+		}
+	})
+
+	return nil
 }
 
 // Unregister a device
 func (pushbots *PushBots) UnregisterDevice(token, platform string) error {
 
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
@@ -139,14 +241,19 @@ func (pushbots *PushBots) UnregisterDevice(token, platform string) error {
 		Platform: platform,
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("unregisterdevice", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("unregisterdevice", args)); err != nil {
+		return err
+	}
+
+	pushbots.forget(token)
+
+	return nil
 }
 
 // Add a tag to a device
 func (pushbots *PushBots) TagDevice(token, platform, alias, tag string) error {
 
-	if err := checkForArgErrorsWithAlias(token, platform, alias); err != nil {
-		fmt.Println(err)
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
 		return err
 	}
 
@@ -157,12 +264,20 @@ func (pushbots *PushBots) TagDevice(token, platform, alias, tag string) error {
 		Tag:      tag,
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("tagdevice", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("tagdevice", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.Tags = addString(device.Tags, tag)
+	})
+
+	return nil
 }
 
 // Remove a tag from a device
 func (pushbots *PushBots) UnTagDevice(token, platform, alias, tag string) error {
-	if err := checkForArgErrorsWithAlias(token, platform, alias); err != nil {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
 		return err
 	}
 
@@ -173,32 +288,35 @@ func (pushbots *PushBots) UnTagDevice(token, platform, alias, tag string) error
 		Tag:      tag,
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("untagdevice", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("untagdevice", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.Tags = removeString(device.Tags, tag)
+	})
+
+	return nil
 }
 
-// Add geo information to a device
+// Add geo information to a device, lat and lng are decimal degrees
 func (pushbots *PushBots) Geo(token, platform, lat, lng string) error {
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
-	if lat == "" || lng == "" {
-		return errors.New("Latitude/Longitude not specified")
-	}
+	coordinates, err := ParseCoordinates(lat, lng)
 
-	args := apiRequest{
-		Token:    token,
-		Platform: platform,
-		Lat:      lat,
-		Lng:      lng,
+	if err != nil {
+		return err
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("geos", args))
+	return pushbots.GeoCoordinates(token, platform, coordinates)
 }
 
 // Adds a notification type to a device
 func (pushbots *PushBots) AddNotificationType(token, platform, alias, notificationType string) error {
-	if err := checkForArgErrorsWithAlias(token, platform, alias); err != nil {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
 		return err
 	}
 
@@ -213,12 +331,20 @@ func (pushbots *PushBots) AddNotificationType(token, platform, alias, notificati
 		NotificationType: notificationType,
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("addnotificationtype", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("addnotificationtype", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.NotificationTypes = addString(device.NotificationTypes, notificationType)
+	})
+
+	return nil
 }
 
 // Removes a notification type from a device
 func (pushbots *PushBots) RemoveNotificationType(token, platform, alias, notificationType string) error {
-	if err := checkForArgErrorsWithAlias(token, platform, alias); err != nil {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
 		return err
 	}
 
@@ -232,7 +358,15 @@ func (pushbots *PushBots) RemoveNotificationType(token, platform, alias, notific
 		Platform:         platform,
 		NotificationType: notificationType,
 	}
-	return checkAndReturn(pushbots.sendToEndpoint("removenotificationtype", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("removenotificationtype", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		device.NotificationTypes = removeString(device.NotificationTypes, notificationType)
+	})
+
+	return nil
 }
 
 // Send a broadcast to multiple devices
@@ -286,7 +420,7 @@ func (pushbots *PushBots) Broadcast(platform string, msg, sound, badge string, p
 
 // Send a push to one device
 func (pushbots *PushBots) SendPushToDevice(platform, token, msg, sound, badge string, payload map[string]interface{}) error {
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
@@ -315,7 +449,7 @@ func (pushbots *PushBots) SendPushToDevice(platform, token, msg, sound, badge st
 		Payload:  payload,
 	}
 
-	return checkAndReturn(pushbots.sendToEndpoint("push/one", args))
+	return checkAndReturn(pushbots.sendToEndpoint("pushone", args))
 }
 
 // Batch push notifications to matching devices
@@ -359,7 +493,7 @@ func (pushbots *PushBots) Batch(platform, msg, sound, badge string, tags, except
 
 // Set the badgecount for a device
 func (pushbots *PushBots) Badge(token, platform string, badgeCount int) error {
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
@@ -368,12 +502,20 @@ func (pushbots *PushBots) Badge(token, platform string, badgeCount int) error {
 		Platform:   platform,
 		BadgeCount: &badgeCount,
 	}
-	return checkAndReturn(pushbots.sendToEndpoint("badge", args))
+	if err := checkAndReturn(pushbots.sendToEndpoint("badge", args)); err != nil {
+		return err
+	}
+
+	pushbots.mirror(token, platform, "", func(device *Device) {
+		device.Badge = badgeCount
+	})
+
+	return nil
 }
 
-// Record analytics for a device
+// Record analytics for a device, stats is a PushBots stat code such as "o" for an open, see RecordEvent
 func (pushbots *PushBots) RecordAnalytics(token, platform, stats string) error {
-	if err := checkForArgErrors(token, platform); err != nil {
+	if err := pushbots.checkArgs(token, platform); err != nil {
 		return err
 	}
 
@@ -388,70 +530,150 @@ func (pushbots *PushBots) RecordAnalytics(token, platform, stats string) error {
 // Prepare and send the request to the endpoint
 func (pushbots *PushBots) sendToEndpoint(endpoint string, args apiRequest) ([]byte, error) {
 
-	if pushbots.endpoints == nil {
-		pushbots.initializeEndpoints("")
+	endpoints := pushbots.endpoints
+
+	if endpoints == nil {
+		endpoints = defaultEndpoints
 	}
 
-	pushbotEndpoint, available := pushbots.endpoints[endpoint]
+	pushbotEndpoint, available := endpoints[endpoint]
 
 	if available == false {
 		return []byte{}, errors.New("Could not find endpoint")
 	}
 
-	jsonPayload, err := json.Marshal(args)
+	jsonPayload, err := encodePayload(args)
 
 	if err != nil {
 		return []byte{}, err
 	}
 
+	defer jsonPayload.release()
+
 	if pushbots.Debug == true {
 
-		fmt.Println("Sending JSON:", string(jsonPayload))
+		fmt.Println("Sending JSON:", string(jsonPayload.Bytes()))
 	}
 
-	req, err := http.NewRequest(pushbotEndpoint.HttpVerb, pushbotEndpoint.Endpoint, strings.NewReader(string(jsonPayload)))
+	credentials, err := pushbots.currentCredentials()
 
 	if err != nil {
 		return []byte{}, err
 	}
 
-	if pushbots.AppId == "" || pushbots.Secret == "" {
-		return []byte{}, errors.New("Appid and/or secret key not set")
+	var generation uint64
+
+	if pushbots.CircuitBreaker != nil {
+		if generation, err = pushbots.CircuitBreaker.allow(endpoint); err != nil {
+			return []byte{}, err
+		}
+	}
+
+	body, statusCode, err := pushbots.send(endpoint, pushbotEndpoint, jsonPayload, credentials)
+
+	// Credentials may have been rotated while the request was in flight, try once more with the new ones
+	if err == nil && (statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden) {
+		if fresh, freshErr := pushbots.currentCredentials(); freshErr == nil && fresh != credentials {
+			body, statusCode, err = pushbots.send(endpoint, pushbotEndpoint, jsonPayload, fresh)
+		}
+	}
+
+	if pushbots.CircuitBreaker != nil {
+		pushbots.CircuitBreaker.record(endpoint, generation, err != nil || statusCode >= 500)
+	}
+
+	if err != nil {
+		return body, err
+	}
+
+	if statusCode != 200 && statusCode != 201 {
+		return body, &ServerError{StatusCode: statusCode, Message: "Error response from server", Body: body}
+	}
+
+	return body, nil
+}
+
+// Sends a request, through the failover endpoints when configured
+func (pushbots *PushBots) send(endpoint string, pushbotEndpoint pushBotRequest, jsonPayload *requestPayload,
+	credentials Credentials) ([]byte, int, error) {
+
+	if pushbots.Failover == nil {
+		return pushbots.doRequest(pushbotEndpoint, jsonPayload, credentials)
+	}
+
+	return pushbots.Failover.do(endpoint, pushbotEndpoint, func(pushbotEndpoint pushBotRequest) ([]byte, int, error) {
+		return pushbots.doRequest(pushbotEndpoint, jsonPayload, credentials)
+	})
+}
+
+// Sends a single request and returns the response body and status code
+func (pushbots *PushBots) doRequest(pushbotEndpoint pushBotRequest, jsonPayload *requestPayload, credentials Credentials) ([]byte, int, error) {
+	if credentials.AppId == "" || credentials.Secret == "" {
+		return []byte{}, 0, errors.New("Appid and/or secret key not set")
+	}
+
+	requestBody := jsonPayload.body()
+	req, err := http.NewRequest(pushbotEndpoint.HttpVerb, pushbotEndpoint.Endpoint, requestBody)
+
+	if err != nil {
+		requestBody.Close()
+		return []byte{}, 0, err
+	}
+
+	req.ContentLength = int64(len(jsonPayload.Bytes()))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return jsonPayload.body(), nil
 	}
 
-	req.Header.Set("x-pushbots-appid", pushbots.AppId)
-	req.Header.Set("x-pushbots-secret", pushbots.Secret)
+	req.Header.Set("x-pushbots-appid", credentials.AppId)
+	req.Header.Set("x-pushbots-secret", credentials.Secret)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := new(http.Client)
+	client := pushbots.HttpClient
+
+	if client == nil {
+		client = new(http.Client)
+	}
+
+	if pushbots.RateLimiter != nil {
+		pushbots.RateLimiter.Wait()
+	}
 
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, 0, err
 	}
 
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	maxResponseSize := pushbots.MaxResponseSize
+
+	if maxResponseSize <= 0 {
+		maxResponseSize = DefaultMaxResponseSize
+	}
+
+	// Reads one byte past the limit to tell a body of exactly the limit from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+
+	if err == nil && int64(len(body)) > maxResponseSize {
+		return []byte{}, resp.StatusCode, ErrResponseTooLarge
+	}
 
 	if pushbots.Debug == true {
 		fmt.Println("Response object:", resp)
 		fmt.Println("Response content", string(body))
 	}
 
-	if resp.StatusCode != 200 && resp.StatusCode != 201 {
-		return body, errors.New("Error response from server")
-	}
-
-	return body, err
+	return body, resp.StatusCode, err
 }
 
 // Checks for errors within arguments
 func checkForArgErrors(token string, platform string) error {
 	if token == "" {
-		return errors.New("Token needs to be a device token")
+		return newValidationError("token", token, "Token needs to be a device token")
 	} else if platform != PlatformIos && platform != PlatformAndroid {
-		return errors.New("Platform must be either PlatformIos or PlatformAndroid")
+		return newValidationError("platform", platform, "Platform must be either PlatformIos or PlatformAndroid")
 	}
 	return nil
 }
@@ -459,11 +681,9 @@ func checkForArgErrors(token string, platform string) error {
 // Checks for errors when either a token or an alias is required
 func checkForArgErrorsWithAlias(token string, platform, alias string) error {
 	if token == "" && alias == "" {
-		return errors.New("Either token or alias need to be set")
+		return newValidationError("token", token, "Either token or alias need to be set")
 	} else if platform != PlatformIos && platform != PlatformAndroid {
-		fmt.Println("Fick platform ", platform)
-		return errors.New("Platform must be either PlatformIos or PlatformAndroid")
-
+		return newValidationError("platform", platform, "Platform must be either PlatformIos or PlatformAndroid")
 	}
 	return nil
 }
@@ -473,28 +693,28 @@ func checkAndReturn(content []byte, err error) error {
 		return err
 	}
 
-	if len(content) > 0 {
-		serverErr := new(serverErrorResponse)
-		err := json.Unmarshal(content, serverErr)
+	if len(content) == 0 {
+		return nil
+	}
 
-		if err != nil {
-			return err
-		}
+	serverErr := new(serverErrorResponse)
 
-		if serverErr.Message == "" {
-			return errors.New("Got response from server but failed to parse")
-		} else {
-			switch serverErr.Message.(type) {
-			case string:
-				return errors.New(serverErr.Message.(string))
-			case map[string]interface{}:
-				return fmt.Errorf("A server error occurred: %s", string(content))
-			default:
-				return fmt.Errorf("Could not parse server message: %s", string(content))
-			}
+	if err := json.Unmarshal(content, serverErr); err != nil {
+		return &ServerError{Message: fmt.Sprintf("Could not parse server response: %s: %s", err, quoteBody(content)), Body: content}
+	}
+
+	switch message := serverErr.Message.(type) {
+	case string:
+		if message == "" {
+			return &ServerError{Message: "Got response from server but failed to parse", Body: content}
 		}
+
+		return &ServerError{Message: message, Body: content}
+	case map[string]interface{}:
+		return &ServerError{Message: fmt.Sprintf("A server error occurred: %s", quoteBody(content)), Body: content}
+	default:
+		return &ServerError{Message: fmt.Sprintf("Could not parse server message: %s", quoteBody(content)), Body: content}
 	}
-	return nil
 }
 
 func generatePlatform(platform string, asArray bool) (interface{}, error) {
@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -90,6 +92,78 @@ func testHandler(t *testing.T, shouldEqual map[string]interface{}) func(http.Res
 	}
 }
 
+// A request received by a recordingServer, with its body decoded as an apiRequest
+type recordedRequest struct {
+	apiRequest
+	Method string
+	URL    *url.URL
+	Header http.Header
+	Body   []byte
+}
+
+// Records every request it receives and answers with an empty success, unless
+// its respond hook writes something else
+type recordingServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []recordedRequest
+}
+
+func newRecordingServer() *recordingServer {
+	return newRespondingServer(nil)
+}
+
+// Creates a recording server calling respond, if not nil, with every request
+// after recording it. respond may write an error response, e.g. for a bad token.
+func newRespondingServer(respond func(w http.ResponseWriter, request recordedRequest)) *recordingServer {
+	recorder := &recordingServer{}
+	recorder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := recordedRequest{Method: r.Method, URL: r.URL, Header: r.Header, Body: body}
+		json.Unmarshal(body, &request.apiRequest)
+
+		recorder.lock.Lock()
+		recorder.requests = append(recorder.requests, request)
+		recorder.lock.Unlock()
+
+		if respond != nil {
+			respond(w, request)
+		}
+	}))
+
+	return recorder
+}
+
+// Returns the requests received so far
+func (recorder *recordingServer) received() []recordedRequest {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	return append([]recordedRequest(nil), recorder.requests...)
+}
+
+// Returns the requests received so far and forgets them
+func (recorder *recordingServer) take() []recordedRequest {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	requests := recorder.requests
+	recorder.requests = nil
+
+	return requests
+}
+
+// Returns the msg of every request received so far
+func (recorder *recordingServer) sent() []string {
+	var messages []string
+
+	for _, request := range recorder.received() {
+		messages = append(messages, request.Msg)
+	}
+
+	return messages
+}
+
 func TestRegisterDevice(t *testing.T) {
 	tags := []string{tag1, tag2}
 	notificationTypes := []string{notificationType1, notificationType2}
@@ -397,6 +471,29 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestMaxResponseSize(t *testing.T) {
+	response := `{"message":"An error"}`
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(resp, response)
+	}))
+	defer testServer.Close()
+	pushBots := NewPushBots(appId, secret, false)
+
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+	pushBots.MaxResponseSize = int64(len(response))
+
+	if _, isServerError := pushBots.Badge(token, PlatformIos, 1).(*ServerError); !isServerError {
+		t.Fatal("A response of exactly the limit should be read")
+	}
+
+	pushBots.MaxResponseSize--
+
+	if err := pushBots.Badge(token, PlatformIos, 1); err != ErrResponseTooLarge {
+		t.Fatal("Expected ErrResponseTooLarge", err)
+	}
+}
+
 func TestCheckForArgErrors(t *testing.T) {
 	t.Parallel()
 	if err := checkForArgErrors("", PlatformIos); err == nil {
@@ -0,0 +1,355 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// QuietHours is a daily period in the local time of a device during which
+// nothing should be delivered. Start and End are offsets from local midnight
+// in [0, 24h), a Start after End spans midnight, e.g. 22h to 8h. Equal values
+// mean no quiet hours.
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Validate checks Start and End are offsets within a day
+func (quietHours QuietHours) Validate() error {
+	if quietHours.Start < 0 || quietHours.Start >= 24*time.Hour {
+		return newValidationError("start", quietHours.Start.String(), "Quiet hours need to start within a day")
+	}
+
+	if quietHours.End < 0 || quietHours.End >= 24*time.Hour {
+		return newValidationError("end", quietHours.End.String(), "Quiet hours need to end within a day")
+	}
+
+	return nil
+}
+
+// Contains reports whether t, in its own location, is within the quiet hours
+func (quietHours QuietHours) Contains(t time.Time) bool {
+	offset := sinceMidnight(t)
+
+	if quietHours.Start < quietHours.End {
+		return offset >= quietHours.Start && offset < quietHours.End
+	}
+
+	if quietHours.Start > quietHours.End {
+		return offset >= quietHours.Start || offset < quietHours.End
+	}
+
+	return false
+}
+
+// NextAllowed returns t if it is outside the quiet hours, otherwise the time they end.
+// Quiet hours that aren't valid may return a time that is still quiet.
+func (quietHours QuietHours) NextAllowed(t time.Time) time.Time {
+	if !quietHours.Contains(t) {
+		return t
+	}
+
+	day := t
+
+	// Quiet hours spanning midnight that started this evening end tomorrow
+	if quietHours.Start > quietHours.End && sinceMidnight(t) >= quietHours.Start {
+		day = t.AddDate(0, 0, 1)
+	}
+
+	// Built from the wall clock rather than by adding durations so DST changes are respected
+	end := quietHours.End
+	year, month, date := day.Date()
+	allowed := time.Date(year, month, date, int(end/time.Hour), int(end%time.Hour/time.Minute),
+		int(end%time.Minute/time.Second), 0, t.Location())
+
+	if allowed.Before(t) {
+		allowed = t
+	}
+
+	// An end inside a DST gap doesn't exist and is normalized to an earlier,
+	// still quiet, time. Move forward an hour boundary at a time past the gap,
+	// at most a day so quiet hours covering all of it can't loop forever.
+	for hours := 0; hours < 24 && quietHours.Contains(allowed); hours++ {
+		allowed = allowed.Truncate(time.Second).Add(time.Hour - sinceMidnight(allowed)%time.Hour)
+	}
+
+	return allowed
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	hour, minute, second := t.Clock()
+
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+}
+
+// Record the time zone of a device in the device store, e.g. Europe/Stockholm
+func (pushbots *PushBots) SetTimeZone(token, platform, timeZone string) error {
+	if err := pushbots.checkArgs(token, platform); err != nil {
+		return err
+	}
+
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return newValidationError("timeZone", timeZone, "Unknown time zone")
+	}
+
+	if pushbots.Devices == nil {
+		return ErrNoDeviceStore
+	}
+
+	return pushbots.updateDevices(token, platform, "", func(device *Device) {
+		device.TimeZone = timeZone
+	})
+}
+
+// TimeZoneBatch is the part of a delivery going to the devices of one time zone
+type TimeZoneBatch struct {
+	TimeZone string
+	SendAt   time.Time
+	Deferred bool     // SendAt is in the future because of quiet hours
+	Tokens   []string // Sorted
+	JobIds   []string // Scheduler jobs of a deferred batch, one per platform
+}
+
+// Returned by NewLocalDelivery without a scheduler to defer quiet batches with
+var ErrNoScheduler = errors.New("LocalDelivery needs a scheduler to defer batches with")
+
+// Returned by LocalDelivery when no device in PushBots.Devices matches the audience
+var ErrNoKnownRecipients = errors.New("No device in PushBots.Devices matches the audience")
+
+// LocalDelivery sends notifications respecting the local time of each device.
+// The audience is resolved against PushBots.Devices and split into one batch
+// per time zone. A batch is sent, or handed to the scheduler for when its
+// quiet hours end, as one notification per platform addressed to the tokens
+// of the batch. Devices missing from the store can't be placed in a time
+// zone and are not reached, tokens addressed directly that are missing fail
+// with ErrDeviceNotFound.
+type LocalDelivery struct {
+	pushBots  *PushBots
+	scheduler *Scheduler
+	Quiet     QuietHours
+	// Time zones by token, used before the time zone in the device store
+	TimeZones map[string]string
+	// Used for devices without a known time zone, nil means UTC
+	DefaultTimeZone *time.Location
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+}
+
+// Create a delivery sending through pushBots and deferring quiet batches with scheduler
+func NewLocalDelivery(pushBots *PushBots, scheduler *Scheduler, quiet QuietHours) (*LocalDelivery, error) {
+	if scheduler == nil {
+		return nil, ErrNoScheduler
+	}
+
+	if err := quiet.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &LocalDelivery{pushBots: pushBots, scheduler: scheduler, Quiet: quiet, Now: time.Now}, nil
+}
+
+// Plan splits the audience into time zone batches without sending anything
+func (delivery *LocalDelivery) Plan(notification Notification, audience Audience) ([]TimeZoneBatch, error) {
+	plan, _, err := delivery.plan(notification, audience)
+
+	return plan, err
+}
+
+// Returns the batches and the platform of every device in them
+func (delivery *LocalDelivery) plan(notification Notification, audience Audience) ([]TimeZoneBatch, map[string]string, error) {
+	if err := delivery.Quiet.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if delivery.pushBots.Devices == nil {
+		return nil, nil, ErrNoDeviceStore
+	}
+
+	devices, err := delivery.pushBots.Devices.List()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := delivery.Now()
+	batches := make(map[string]*TimeZoneBatch)
+	platforms := make(map[string]string)
+	var names []string
+
+	for _, device := range devices {
+		if !audience.matches(notification.Platform, device) {
+			continue
+		}
+
+		location, err := delivery.location(device)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		batch, found := batches[location.String()]
+
+		if !found {
+			sendAt := delivery.Quiet.NextAllowed(now.In(location))
+
+			batch = &TimeZoneBatch{TimeZone: location.String(), SendAt: sendAt, Deferred: sendAt.After(now)}
+			batches[batch.TimeZone] = batch
+			names = append(names, batch.TimeZone)
+		}
+
+		batch.Tokens = append(batch.Tokens, device.Token)
+		platforms[device.Token] = device.Platform
+	}
+
+	sort.Strings(names)
+
+	plan := make([]TimeZoneBatch, len(names))
+
+	for i, name := range names {
+		plan[i] = *batches[name]
+		sort.Strings(plan[i].Tokens)
+	}
+
+	return plan, platforms, nil
+}
+
+// Send delivers the notification to the audience right away where it is
+// outside quiet hours and schedules it for everyone else. The returned
+// batches record what happened, failed devices are reported as DeliveryErrors.
+func (delivery *LocalDelivery) Send(notification Notification, audience Audience) ([]TimeZoneBatch, error) {
+	plan, platforms, err := delivery.plan(notification, audience)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deliveryErrors := make(DeliveryErrors)
+
+	for _, token := range append([]string{audience.Token}, audience.Tokens...) {
+		if _, found := platforms[token]; token != "" && !found {
+			deliveryErrors[token] = ErrDeviceNotFound
+		}
+	}
+
+	if len(plan) == 0 && len(deliveryErrors) == 0 {
+		return nil, ErrNoKnownRecipients
+	}
+
+	for i := range plan {
+		batch := &plan[i]
+
+		for _, platform := range []string{PlatformIos, PlatformAndroid} {
+			var tokens []string
+
+			for _, token := range batch.Tokens {
+				if platforms[token] == platform {
+					tokens = append(tokens, token)
+				}
+			}
+
+			if len(tokens) == 0 {
+				continue
+			}
+
+			perPlatform := notification
+			perPlatform.Platform = platform
+			recipients := Audience{Tokens: tokens}
+
+			if batch.Deferred {
+				job, err := delivery.scheduler.Schedule(perPlatform, recipients, batch.SendAt)
+
+				if err == nil {
+					batch.JobIds = append(batch.JobIds, job.Id)
+				}
+
+				deliveryErrors.add(tokens, err)
+			} else {
+				deliveryErrors.add(tokens, delivery.pushBots.SendNotification(perPlatform, recipients))
+			}
+		}
+	}
+
+	if len(deliveryErrors) > 0 {
+		return plan, deliveryErrors
+	}
+
+	return plan, nil
+}
+
+func (delivery *LocalDelivery) location(device Device) (*time.Location, error) {
+	name := delivery.TimeZones[device.Token]
+
+	if name == "" {
+		name = device.TimeZone
+	}
+
+	if name == "" {
+		if delivery.DefaultTimeZone != nil {
+			return delivery.DefaultTimeZone, nil
+		}
+
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(name)
+
+	if err != nil {
+		return nil, newValidationError("timeZone", name, "Unknown time zone for device "+device.Token)
+	}
+
+	return location, nil
+}
+
+// Reports whether a device on platform is part of the audience, mirroring how
+// PushBots selects devices for a batch: any of the tags or notification types
+// and none of the excluded ones.
+func (audience Audience) matches(platform string, device Device) bool {
+	if platform != PlatformAll && device.Platform != platform {
+		return false
+	}
+
+	if audience.Token != "" {
+		return device.Token == audience.Token
+	}
+
+	if len(audience.Tokens) > 0 {
+		return containsString(audience.Tokens, device.Token)
+	}
+
+	if audience.Alias != "" && device.Alias != audience.Alias {
+		return false
+	}
+
+	if audience.ExceptAlias != "" && device.Alias == audience.ExceptAlias {
+		return false
+	}
+
+	if len(audience.Tags) > 0 && !containsAny(device.Tags, audience.Tags) {
+		return false
+	}
+
+	if containsAny(device.Tags, audience.ExceptTags) {
+		return false
+	}
+
+	if len(audience.NotificationTypes) > 0 && !containsAny(device.NotificationTypes, audience.NotificationTypes) {
+		return false
+	}
+
+	return !containsAny(device.NotificationTypes, audience.ExceptNotificationTypes)
+}
+
+func containsAny(values, candidates []string) bool {
+	for _, candidate := range candidates {
+		if containsString(values, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
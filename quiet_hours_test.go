@@ -0,0 +1,230 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+
+	if err != nil {
+		t.Skip("No time zone database", err)
+	}
+
+	overnight := QuietHours{Start: 22 * time.Hour, End: 8 * time.Hour}
+	afternoon := QuietHours{Start: 13 * time.Hour, End: 14*time.Hour + 30*time.Minute}
+
+	tests := []struct {
+		quietHours QuietHours
+		at         time.Time
+		expected   time.Time
+	}{
+		{overnight, time.Date(2014, 1, 1, 12, 0, 0, 0, stockholm), time.Date(2014, 1, 1, 12, 0, 0, 0, stockholm)},
+		{overnight, time.Date(2014, 1, 1, 23, 0, 0, 0, stockholm), time.Date(2014, 1, 2, 8, 0, 0, 0, stockholm)},
+		{overnight, time.Date(2014, 1, 1, 3, 0, 0, 0, stockholm), time.Date(2014, 1, 1, 8, 0, 0, 0, stockholm)},
+		{overnight, time.Date(2014, 1, 1, 8, 0, 0, 0, stockholm), time.Date(2014, 1, 1, 8, 0, 0, 0, stockholm)},
+		{afternoon, time.Date(2014, 1, 1, 13, 10, 0, 0, stockholm), time.Date(2014, 1, 1, 14, 30, 0, 0, stockholm)},
+		// The night clocks go forward is an hour shorter
+		{overnight, time.Date(2014, 3, 29, 23, 0, 0, 0, stockholm), time.Date(2014, 3, 30, 8, 0, 0, 0, stockholm)},
+		{QuietHours{}, time.Date(2014, 1, 1, 3, 0, 0, 0, stockholm), time.Date(2014, 1, 1, 3, 0, 0, 0, stockholm)},
+	}
+
+	for _, test := range tests {
+		if next := test.quietHours.NextAllowed(test.at); !next.Equal(test.expected) {
+			t.Fatal("Wrong next allowed time for", test.at, "got", next, "expected", test.expected)
+		}
+	}
+}
+
+func TestQuietHoursDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+
+	if err != nil {
+		t.Skip("No time zone database", err)
+	}
+
+	// Clocks go from 02:00 to 03:00 on 2016-03-13, so 02:30 doesn't exist that night
+	quietHours := QuietHours{Start: 22 * time.Hour, End: 2*time.Hour + 30*time.Minute}
+
+	tests := []struct {
+		at       time.Time
+		expected time.Time
+	}{
+		{time.Date(2016, 3, 12, 23, 0, 0, 0, newYork), time.Date(2016, 3, 13, 3, 0, 0, 0, newYork)},
+		{time.Date(2016, 3, 13, 1, 45, 0, 0, newYork), time.Date(2016, 3, 13, 3, 0, 0, 0, newYork)},
+		{time.Date(2016, 3, 13, 23, 0, 0, 0, newYork), time.Date(2016, 3, 14, 2, 30, 0, 0, newYork)},
+		// The night clocks go back is an hour longer
+		{time.Date(2016, 11, 5, 23, 0, 0, 0, newYork), time.Date(2016, 11, 6, 2, 30, 0, 0, newYork)},
+	}
+
+	for _, test := range tests {
+		next := quietHours.NextAllowed(test.at)
+
+		if !next.Equal(test.expected) || quietHours.Contains(next) {
+			t.Fatal("Wrong next allowed time for", test.at, "got", next, "expected", test.expected)
+		}
+	}
+}
+
+func TestQuietHoursFullDay(t *testing.T) {
+	fullDay := QuietHours{Start: 0, End: 24 * time.Hour}
+	done := make(chan time.Time)
+
+	go func() {
+		done <- fullDay.NextAllowed(time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NextAllowed didn't return for quiet hours covering the whole day")
+	}
+
+	for _, quietHours := range []QuietHours{fullDay, {Start: time.Hour, End: 25 * time.Hour}, {Start: -time.Hour}} {
+		if _, ok := quietHours.Validate().(*ValidationError); !ok {
+			t.Fatal("Expected a ValidationError for", quietHours)
+		}
+	}
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.Devices = NewMemoryDeviceStore()
+	scheduler := NewScheduler(&pushBots, NewMemoryJobStore())
+
+	if _, err := NewLocalDelivery(&pushBots, scheduler, fullDay); err == nil {
+		t.Fatal("NewLocalDelivery should refuse quiet hours covering the whole day")
+	}
+
+	delivery, err := NewLocalDelivery(&pushBots, scheduler, QuietHours{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery.Quiet = fullDay
+
+	if _, err := delivery.Plan(Notification{Platform: PlatformAll}, Audience{}); err == nil {
+		t.Fatal("Plan should refuse quiet hours covering the whole day")
+	}
+
+	if _, err := delivery.Send(Notification{Platform: PlatformAll}, Audience{}); err == nil {
+		t.Fatal("Send should refuse quiet hours covering the whole day")
+	}
+}
+
+func TestLocalDelivery(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+
+	if err != nil {
+		t.Skip("No time zone database", err)
+	}
+
+	server := newRecordingServer()
+	defer server.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(server.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+
+	for _, device := range []Device{
+		{Token: "stockholm-1", Platform: PlatformIos, Tags: []string{tag1}},
+		{Token: "stockholm-2", Platform: PlatformAndroid, Tags: []string{tag1}},
+		{Token: "new-york", Platform: PlatformIos, Tags: []string{tag1}},
+		{Token: "new-york-2", Platform: PlatformIos, Tags: []string{tag1}, TimeZone: "America/New_York"},
+		{Token: "tokyo", Platform: PlatformIos, Tags: []string{tag1}},
+		{Token: "untagged", Platform: PlatformIos, TimeZone: "Europe/Stockholm"},
+	} {
+		pushBots.Devices.Save(device)
+	}
+
+	for _, device := range []Device{
+		{Token: "stockholm-1", Platform: PlatformIos, TimeZone: "Europe/Stockholm"},
+		{Token: "stockholm-2", Platform: PlatformAndroid, TimeZone: "Europe/Stockholm"},
+		{Token: "new-york", Platform: PlatformIos, TimeZone: "America/New_York"},
+	} {
+		if err := pushBots.SetTimeZone(device.Token, device.Platform, device.TimeZone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pushBots.SetTimeZone(token, PlatformIos, "Mars/Olympus_Mons"); err == nil {
+		t.Fatal("Unknown time zone should fail")
+	}
+
+	// 12:00 UTC is 13:00 in Stockholm, 08:00 in New York and 21:00 in Tokyo
+	now := time.Date(2014, 6, 2, 12, 0, 0, 0, time.UTC)
+
+	scheduler := NewScheduler(&pushBots, NewMemoryJobStore())
+	scheduler.Now = func() time.Time { return now }
+
+	if _, err := NewLocalDelivery(&pushBots, nil, QuietHours{}); err != ErrNoScheduler {
+		t.Fatal("Expected ErrNoScheduler, got", err)
+	}
+
+	delivery, err := NewLocalDelivery(&pushBots, scheduler, QuietHours{Start: 20 * time.Hour, End: 9 * time.Hour})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery.TimeZones = map[string]string{"tokyo": "Asia/Tokyo"}
+	delivery.Now = func() time.Time { return now }
+
+	batches, err := delivery.Send(Notification{Platform: PlatformAll, Msg: msg, Sound: sound}, Audience{Tags: []string{tag1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 3 {
+		t.Fatal("Expected one batch per time zone", batches)
+	}
+
+	newYork, tokyoBatch, stockholm := batches[0], batches[1], batches[2]
+
+	if stockholm.Deferred || !reflect.DeepEqual(stockholm.Tokens, []string{"stockholm-1", "stockholm-2"}) {
+		t.Fatal("Stockholm should be sent right away", stockholm)
+	}
+
+	// Both New York devices are in one job
+	if !newYork.Deferred || !newYork.SendAt.Equal(time.Date(2014, 6, 2, 13, 0, 0, 0, time.UTC)) || len(newYork.JobIds) != 1 ||
+		len(newYork.Tokens) != 2 {
+		t.Fatal("New York should wait until 09:00 local", newYork)
+	}
+
+	if !tokyoBatch.Deferred || !tokyoBatch.SendAt.Equal(time.Date(2014, 6, 3, 9, 0, 0, 0, tokyo)) {
+		t.Fatal("Tokyo should wait until tomorrow morning", tokyoBatch)
+	}
+
+	if sent := server.sent(); len(sent) != 2 {
+		t.Fatal("Only Stockholm should be sent now", sent)
+	}
+
+	now = time.Date(2014, 6, 2, 13, 0, 0, 0, time.UTC)
+
+	if count, err := scheduler.RunDue(); err != nil || count != 1 || len(server.sent()) != 4 {
+		t.Fatal("New York should be due at 09:00 local", count, err)
+	}
+
+	now = time.Date(2014, 6, 3, 0, 0, 0, 0, time.UTC)
+
+	if count, _ := scheduler.RunDue(); count != 1 {
+		t.Fatal("Tokyo should be due at 09:00 local", count)
+	}
+
+	// Devices that aren't in the store are reported rather than skipped
+	_, err = delivery.Send(Notification{Platform: PlatformIos, Msg: msg}, Audience{Tokens: []string{"tokyo", "unknown"}})
+
+	if deliveryErrors, ok := err.(DeliveryErrors); !ok || len(deliveryErrors) != 1 || deliveryErrors["unknown"] != ErrDeviceNotFound {
+		t.Fatal("Unknown token should be reported", err)
+	}
+
+	if _, err := delivery.Send(Notification{Platform: PlatformIos, Msg: msg}, Audience{Tags: []string{"nobody"}}); err != ErrNoKnownRecipients {
+		t.Fatal("Expected ErrNoKnownRecipients, got", err)
+	}
+}
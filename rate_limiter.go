@@ -0,0 +1,70 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket allowing a steady number of requests per
+// second with bursts up to a fixed size. It is safe for concurrent use.
+type RateLimiter struct {
+	lock      sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	now       func() time.Time
+	sleep     func(time.Duration)
+}
+
+// Create a limiter allowing perSecond requests with bursts of up to burst requests.
+// A perSecond of zero or less disables limiting.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// Reserve takes a token and returns how long the caller has to wait before using it
+func (limiter *RateLimiter) Reserve() time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.perSecond
+
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+
+	limiter.last = now
+	limiter.tokens--
+
+	if limiter.tokens >= 0 || limiter.perSecond <= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.tokens / limiter.perSecond * float64(time.Second))
+}
+
+// Wait blocks until a request may be sent
+func (limiter *RateLimiter) Wait() {
+	if delay := limiter.Reserve(); delay > 0 {
+		limiter.sleep(delay)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 2)
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available straight away
+	if limiter.Reserve() != 0 || limiter.Reserve() != 0 {
+		t.Fatal("Burst should not wait")
+	}
+
+	if delay := limiter.Reserve(); delay != 500*time.Millisecond {
+		t.Fatal("Expected to wait half a second, got", delay)
+	}
+
+	if delay := limiter.Reserve(); delay != time.Second {
+		t.Fatal("Waits should queue up, got", delay)
+	}
+
+	// Tokens refill over time but never beyond the burst
+	now = now.Add(time.Hour)
+
+	if limiter.Reserve() != 0 || limiter.Reserve() != 0 || limiter.Reserve() == 0 {
+		t.Fatal("Refill should be capped at the burst size")
+	}
+
+	unlimited := NewRateLimiter(0, 1)
+
+	for i := 0; i < 10; i++ {
+		if unlimited.Reserve() != 0 {
+			t.Fatal("Zero rate should not limit")
+		}
+	}
+}
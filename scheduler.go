@@ -0,0 +1,483 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by job stores when a job id is unknown
+var ErrJobNotFound = errors.New("Scheduled job not found")
+
+// ScheduledJob is a notification waiting to be sent.
+// One-off jobs are removed once sent and retried with backoff when sending
+// fails, cron jobs are moved to their next run.
+type ScheduledJob struct {
+	Id           string       `json:"id"`
+	Notification Notification `json:"notification"`
+	Audience     Audience     `json:"audience"`
+	SendAt       time.Time    `json:"send_at"`             // Next time the job runs
+	Cron         string       `json:"cron,omitempty"`      // Cron expression for recurring jobs
+	TimeZone     string       `json:"time_zone,omitempty"` // IANA zone the cron expression is evaluated in
+	LastRun      time.Time    `json:"last_run,omitempty"`
+	LastError    string       `json:"last_error,omitempty"`
+	Attempts     int          `json:"attempts,omitempty"` // Failed attempts at sending a one-off job
+	// Set when a one-off job ran out of attempts, it is kept but not sent until rescheduled
+	Failed bool `json:"failed,omitempty"`
+}
+
+// JobStore persists scheduled jobs so they survive restarts
+type JobStore interface {
+	Save(job ScheduledJob) error
+	Get(id string) (ScheduledJob, error)
+	Delete(id string) error
+	List() ([]ScheduledJob, error)
+}
+
+// MemoryJobStore keeps jobs in memory, mostly useful for tests
+type MemoryJobStore struct {
+	lock sync.Mutex
+	jobs map[string]ScheduledJob
+}
+
+// Create an empty in memory job store
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[string]ScheduledJob)}
+}
+
+func (store *MemoryJobStore) Save(job ScheduledJob) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.jobs[job.Id] = job
+	return nil
+}
+
+func (store *MemoryJobStore) Get(id string) (ScheduledJob, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	job, found := store.jobs[id]
+
+	if !found {
+		return ScheduledJob{}, ErrJobNotFound
+	}
+
+	return job, nil
+}
+
+func (store *MemoryJobStore) Delete(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, found := store.jobs[id]; !found {
+		return ErrJobNotFound
+	}
+
+	delete(store.jobs, id)
+	return nil
+}
+
+func (store *MemoryJobStore) List() ([]ScheduledJob, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	jobs := make([]ScheduledJob, 0, len(store.jobs))
+
+	for _, job := range store.jobs {
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// FileJobStore keeps all jobs in a single JSON file.
+// Every change rewrites the file through a temporary file and a rename,
+// so a crash never leaves a half written store behind.
+type FileJobStore struct {
+	path   string
+	memory *MemoryJobStore
+}
+
+// Open or create a file backed job store
+func NewFileJobStore(path string) (*FileJobStore, error) {
+	store := &FileJobStore{path: path, memory: NewMemoryJobStore()}
+
+	content, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var jobs []ScheduledJob
+
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		store.memory.jobs[job.Id] = job
+	}
+
+	return store, nil
+}
+
+func (store *FileJobStore) Save(job ScheduledJob) error {
+	store.memory.lock.Lock()
+	defer store.memory.lock.Unlock()
+
+	store.memory.jobs[job.Id] = job
+	return store.flush()
+}
+
+func (store *FileJobStore) Get(id string) (ScheduledJob, error) {
+	return store.memory.Get(id)
+}
+
+func (store *FileJobStore) Delete(id string) error {
+	store.memory.lock.Lock()
+	defer store.memory.lock.Unlock()
+
+	if _, found := store.memory.jobs[id]; !found {
+		return ErrJobNotFound
+	}
+
+	delete(store.memory.jobs, id)
+	return store.flush()
+}
+
+func (store *FileJobStore) List() ([]ScheduledJob, error) {
+	return store.memory.List()
+}
+
+// Writes every job to disk, the caller holds the lock
+func (store *FileJobStore) flush() error {
+	jobs := make([]ScheduledJob, 0, len(store.memory.jobs))
+
+	for _, job := range store.memory.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Sort(jobsBySendAt(jobs))
+
+	content, err := json.MarshalIndent(jobs, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(store.path, content)
+}
+
+// Writes content to a temporary file next to path and renames it into place.
+// The file is synced before the rename and the directory after it, so after a
+// crash path holds either the old or the new content in full.
+func writeFileAtomic(path string, content []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// Syncs a directory so a rename in it is durable. Windows can't sync directories
+// and doesn't need to.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
+
+type jobsBySendAt []ScheduledJob
+
+func (jobs jobsBySendAt) Len() int           { return len(jobs) }
+func (jobs jobsBySendAt) Swap(i, j int)      { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs jobsBySendAt) Less(i, j int) bool { return jobs[i].SendAt.Before(jobs[j].SendAt) }
+
+// Scheduler sends notifications at a given time or on a cron schedule.
+// Jobs live in a JobStore, a new Scheduler on the same store picks up where
+// the previous process left off; jobs that became due while nothing was
+// running are sent on the first check.
+type Scheduler struct {
+	pushBots *PushBots
+	store    JobStore
+	// Called with the job and error whenever sending a job fails, may be nil
+	OnError func(job ScheduledJob, err error)
+	// Attempts at sending a one-off job before it is marked Failed, defaults to 5
+	MaxAttempts int
+	// Delay before retrying a one-off job after the given number of failed attempts, defaults to exponential from one second
+	Backoff func(attempts int) time.Duration
+	// Returns the current time, replace it in tests
+	Now func() time.Time
+
+	lock sync.Mutex // Serializes runs and changes to jobs
+	loop backgroundLoop
+}
+
+// Create a scheduler sending through pushBots and persisting jobs in store
+func NewScheduler(pushBots *PushBots, store JobStore) *Scheduler {
+	return &Scheduler{pushBots: pushBots, store: store, MaxAttempts: 5, Backoff: exponentialBackoff, Now: time.Now}
+}
+
+// Schedule a notification to be sent once at sendAt
+func (scheduler *Scheduler) Schedule(notification Notification, audience Audience, sendAt time.Time) (ScheduledJob, error) {
+	job := ScheduledJob{
+		Id:           newJobId(),
+		Notification: notification,
+		Audience:     audience,
+		SendAt:       sendAt,
+	}
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	return job, scheduler.store.Save(job)
+}
+
+// Schedule a notification to be sent every time the cron expression matches in location.
+// A nil location means UTC.
+func (scheduler *Scheduler) ScheduleCron(notification Notification, audience Audience, expression string,
+	location *time.Location) (ScheduledJob, error) {
+
+	if location == nil {
+		location = time.UTC
+	}
+
+	cronSchedule, err := ParseCron(expression)
+
+	if err != nil {
+		return ScheduledJob{}, err
+	}
+
+	next := cronSchedule.Next(scheduler.Now().In(location))
+
+	if next.IsZero() {
+		return ScheduledJob{}, errors.New("Cron expression never matches")
+	}
+
+	job := ScheduledJob{
+		Id:           newJobId(),
+		Notification: notification,
+		Audience:     audience,
+		SendAt:       next,
+		Cron:         expression,
+		TimeZone:     location.String(),
+	}
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	return job, scheduler.store.Save(job)
+}
+
+// List every pending job ordered by the time it is due
+func (scheduler *Scheduler) List() ([]ScheduledJob, error) {
+	jobs, err := scheduler.store.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(jobsBySendAt(jobs))
+
+	return jobs, nil
+}
+
+// Cancel a pending job
+func (scheduler *Scheduler) Cancel(id string) error {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	return scheduler.store.Delete(id)
+}
+
+// Move the next run of a job to sendAt. Cron jobs resume their schedule afterwards,
+// failed one-off jobs get their attempts back.
+func (scheduler *Scheduler) Reschedule(id string, sendAt time.Time) error {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	job, err := scheduler.store.Get(id)
+
+	if err != nil {
+		return err
+	}
+
+	job.SendAt = sendAt
+	job.Attempts = 0
+	job.Failed = false
+
+	return scheduler.store.Save(job)
+}
+
+// RunDue sends every job that is due and returns how many were sent successfully.
+// A one-off job that fails is retried with Backoff, after MaxAttempts or a
+// validation error it is kept with Failed set.
+func (scheduler *Scheduler) RunDue() (int, error) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	now := scheduler.Now()
+	jobs, err := scheduler.store.List()
+
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Sort(jobsBySendAt(jobs))
+	sent := 0
+
+	for _, job := range jobs {
+		if job.SendAt.After(now) {
+			break
+		}
+
+		if job.Failed {
+			continue
+		}
+
+		sendErr := scheduler.pushBots.SendNotification(job.Notification, job.Audience)
+
+		if sendErr != nil && scheduler.OnError != nil {
+			scheduler.OnError(job, sendErr)
+		} else if sendErr == nil {
+			sent++
+		}
+
+		if job.Cron == "" {
+			if err := scheduler.retire(&job, now, sendErr); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		if err := scheduler.advance(&job, now, sendErr); err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// Deletes a one-off job once sent, or records the failure and schedules a retry
+func (scheduler *Scheduler) retire(job *ScheduledJob, now time.Time, sendErr error) error {
+	if sendErr == nil {
+		return scheduler.store.Delete(job.Id)
+	}
+
+	job.LastRun = now
+	job.LastError = sendErr.Error()
+	job.Attempts++
+
+	_, permanent := sendErr.(*ValidationError)
+
+	if permanent || job.Attempts >= scheduler.MaxAttempts {
+		job.Failed = true
+	} else {
+		job.SendAt = now.Add(scheduler.Backoff(job.Attempts))
+	}
+
+	return scheduler.store.Save(*job)
+}
+
+// Moves a cron job to its next run after now, skipping runs missed while down
+func (scheduler *Scheduler) advance(job *ScheduledJob, now time.Time, sendErr error) error {
+	location, err := time.LoadLocation(job.TimeZone)
+
+	if err != nil {
+		return err
+	}
+
+	cronSchedule, err := ParseCron(job.Cron)
+
+	if err != nil {
+		return err
+	}
+
+	job.LastRun = now
+	job.LastError = ""
+
+	if sendErr != nil {
+		job.LastError = sendErr.Error()
+	}
+
+	job.SendAt = cronSchedule.Next(now.In(location))
+
+	if job.SendAt.IsZero() {
+		return scheduler.store.Delete(job.Id)
+	}
+
+	return scheduler.store.Save(*job)
+}
+
+// Start checking for due jobs every interval in the background, interval must be positive
+func (scheduler *Scheduler) Start(interval time.Duration) error {
+	return scheduler.loop.start(interval, func() { scheduler.RunDue() })
+}
+
+// Stop the background loop started by Start and wait for it to finish
+func (scheduler *Scheduler) Stop() {
+	scheduler.loop.stop()
+}
+
+// Random 128 bit hex id
+func newJobId() string {
+	bytes := make([]byte, 16)
+
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(bytes)
+}
@@ -0,0 +1,277 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Errors reported to OnError, which may be called from the background loop
+type schedulerErrors struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+// Fails the test if any job failed, call it from the test goroutine
+func (schedulerErrors *schedulerErrors) check(t *testing.T) {
+	schedulerErrors.lock.Lock()
+	defer schedulerErrors.lock.Unlock()
+
+	if len(schedulerErrors.errors) > 0 {
+		t.Fatal("Sending a job failed", schedulerErrors.errors)
+	}
+}
+
+func newSchedulerForTest(store JobStore, serverURL string, now *time.Time) (*Scheduler, *schedulerErrors) {
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(serverURL + "/")
+
+	failures := &schedulerErrors{}
+	scheduler := NewScheduler(&pushBots, store)
+	scheduler.Now = func() time.Time { return *now }
+	scheduler.OnError = func(job ScheduledJob, err error) {
+		failures.lock.Lock()
+		failures.errors = append(failures.errors, err)
+		failures.lock.Unlock()
+	}
+
+	return scheduler, failures
+}
+
+func TestSchedulerOneOff(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	scheduler, failures := newSchedulerForTest(NewMemoryJobStore(), server.URL, &now)
+	notification := Notification{Platform: PlatformIos, Msg: "Good morning"}
+
+	job, err := scheduler.Schedule(notification, Audience{Token: token}, now.Add(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, _ := scheduler.Schedule(notification, Audience{}, now.Add(time.Hour))
+
+	if err := scheduler.Cancel(cancelled.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := scheduler.Cancel(cancelled.Id); err != ErrJobNotFound {
+		t.Fatal("Expected ErrJobNotFound, got", err)
+	}
+
+	if sent, _ := scheduler.RunDue(); sent != 0 {
+		t.Fatal("Nothing should be due yet")
+	}
+
+	if err := scheduler.Reschedule(job.Id, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+
+	if sent, _ := scheduler.RunDue(); sent != 0 {
+		t.Fatal("Rescheduled job should not be due yet")
+	}
+
+	now = now.Add(time.Hour)
+
+	if sent, err := scheduler.RunDue(); err != nil || sent != 1 {
+		t.Fatal("Expected the job to be sent", sent, err)
+	}
+
+	if jobs, _ := scheduler.List(); len(jobs) != 0 {
+		t.Fatal("One-off job should be removed once sent", jobs)
+	}
+
+	if messages := server.sent(); len(messages) != 1 || messages[0] != "Good morning" {
+		t.Fatal("Wrong messages sent", messages)
+	}
+
+	failures.check(t)
+}
+
+func TestSchedulerCronSurvivesRestart(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "scheduler")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+
+	store, err := NewFileJobStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	scheduler, failures := newSchedulerForTest(store, server.URL, &now)
+	notification := Notification{Platform: PlatformIos, Msg: "Daily"}
+
+	job, err := scheduler.ScheduleCron(notification, Audience{Tags: []string{tag1}}, "0 9 * * *", time.UTC)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !job.SendAt.Equal(time.Date(2016, 1, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Fatal("Wrong first run", job.SendAt)
+	}
+
+	// The process is down for two days, a new one opens the same file
+	now = time.Date(2016, 1, 3, 12, 0, 0, 0, time.UTC)
+	store, err = NewFileJobStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures.check(t)
+	scheduler, failures = newSchedulerForTest(store, server.URL, &now)
+
+	if sent, err := scheduler.RunDue(); err != nil || sent != 1 {
+		t.Fatal("Missed run should be sent once", sent, err)
+	}
+
+	jobs, err := scheduler.List()
+
+	if err != nil || len(jobs) != 1 {
+		t.Fatal("Cron job should still be scheduled", jobs, err)
+	}
+
+	if !jobs[0].SendAt.Equal(time.Date(2016, 1, 4, 9, 0, 0, 0, time.UTC)) {
+		t.Fatal("Cron job should move to the next run", jobs[0].SendAt)
+	}
+
+	if _, err := scheduler.ScheduleCron(notification, Audience{}, "bad", nil); err == nil {
+		t.Fatal("Invalid cron expression should be rejected")
+	}
+
+	failures.check(t)
+}
+
+func TestSchedulerRetriesFailedJob(t *testing.T) {
+	failures := 2
+	var lock sync.Mutex
+
+	server := newRespondingServer(func(w http.ResponseWriter, request recordedRequest) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	defer server.Close()
+
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(server.URL + "/")
+
+	scheduler := NewScheduler(&pushBots, NewMemoryJobStore())
+	scheduler.Now = func() time.Time { return now }
+	scheduler.Backoff = func(attempts int) time.Duration { return time.Duration(attempts) * time.Minute }
+
+	job, err := scheduler.Schedule(Notification{Platform: PlatformIos, Msg: msg}, Audience{Token: token}, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent, err := scheduler.RunDue(); err != nil || sent != 0 {
+		t.Fatal("First attempt should fail", sent, err)
+	}
+
+	jobs, _ := scheduler.List()
+
+	if len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError == "" || !jobs[0].SendAt.Equal(now.Add(time.Minute)) {
+		t.Fatal("Failed job should be kept and retried after the backoff", jobs)
+	}
+
+	now = now.Add(time.Minute)
+	scheduler.RunDue()
+	now = now.Add(2 * time.Minute)
+
+	if sent, err := scheduler.RunDue(); err != nil || sent != 1 {
+		t.Fatal("Third attempt should succeed", sent, err)
+	}
+
+	if jobs, _ := scheduler.List(); len(jobs) != 0 {
+		t.Fatal("Job should be removed once sent", jobs)
+	}
+
+	// A job out of attempts is kept as failed until rescheduled
+	lock.Lock()
+	failures = 1
+	lock.Unlock()
+
+	scheduler.MaxAttempts = 1
+	job, _ = scheduler.Schedule(Notification{Platform: PlatformIos, Msg: msg}, Audience{Token: token}, now)
+	scheduler.RunDue()
+	now = now.Add(time.Hour)
+
+	if sent, _ := scheduler.RunDue(); sent != 0 {
+		t.Fatal("Failed job should not be retried")
+	}
+
+	if jobs, _ := scheduler.List(); len(jobs) != 1 || !jobs[0].Failed {
+		t.Fatal("Job out of attempts should be kept as failed", jobs)
+	}
+
+	if err := scheduler.Reschedule(job.Id, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent, err := scheduler.RunDue(); err != nil || sent != 1 {
+		t.Fatal("Rescheduled job should be sent", sent, err)
+	}
+}
+
+func TestSchedulerStartStop(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+
+	now := time.Now()
+	scheduler, failures := newSchedulerForTest(NewMemoryJobStore(), server.URL, &now)
+
+	if _, err := scheduler.Schedule(Notification{Platform: PlatformIos, Msg: "now"}, Audience{}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := scheduler.Start(0); err == nil {
+		t.Fatal("Start should refuse an interval that isn't positive")
+	}
+
+	if err := scheduler.Start(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(server.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	scheduler.Stop()
+	failures.check(t)
+
+	if len(server.sent()) != 1 {
+		t.Fatal("Expected the due job to be sent by the background loop")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Maximum number of concurrent tag calls issued by the bulk tag operations
+const maxConcurrentTagCalls = 8
+
+// Operations reported in a TagResult
+const (
+	TagAdded     = "added"
+	TagRemoved   = "removed"
+	TagUnchanged = "unchanged" // Already in the wanted state according to the device store, no call made
+)
+
+// TagResult is the outcome for a single tag of a bulk tag operation
+type TagResult struct {
+	Tag       string
+	Operation string
+	Err       error
+}
+
+// TagErrors holds the error of every tag that failed, keyed by tag
+type TagErrors map[string]error
+
+func (tagErrors TagErrors) Error() string {
+	return formatErrorMap("Tag operations failed for ", tagErrors)
+}
+
+// Returned by operations that need PushBots.Devices to know the current state of devices
+var ErrNoDeviceStore = errors.New("PushBots.Devices must be set to know the current state of devices")
+
+// Add several tags to a device. Tags the device store says the device
+// already has are skipped, the rest are added concurrently.
+func (pushbots *PushBots) AddTags(token, platform, alias string, tags []string) ([]TagResult, error) {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
+		return nil, err
+	}
+
+	current, err := pushbots.knownTags(token, platform, alias)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var toAdd, unchanged []string
+
+	for _, tag := range uniqueStrings(tags) {
+		if current != nil && current.hasEverywhere(tag) {
+			unchanged = append(unchanged, tag)
+		} else {
+			toAdd = append(toAdd, tag)
+		}
+	}
+
+	return pushbots.applyTags(token, platform, alias, toAdd, nil, unchanged)
+}
+
+// Remove several tags from a device. Tags the device store says the device
+// doesn't have are skipped, the rest are removed concurrently.
+func (pushbots *PushBots) RemoveTags(token, platform, alias string, tags []string) ([]TagResult, error) {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
+		return nil, err
+	}
+
+	current, err := pushbots.knownTags(token, platform, alias)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var toRemove, unchanged []string
+
+	for _, tag := range uniqueStrings(tags) {
+		if current != nil && !current.hasAnywhere(tag) {
+			unchanged = append(unchanged, tag)
+		} else {
+			toRemove = append(toRemove, tag)
+		}
+	}
+
+	return pushbots.applyTags(token, platform, alias, nil, toRemove, unchanged)
+}
+
+// Replace the tags of a device with tags, adding and removing only what differs.
+// Requires PushBots.Devices, otherwise ErrNoDeviceStore is returned.
+func (pushbots *PushBots) SetTags(token, platform, alias string, tags []string) ([]TagResult, error) {
+	if err := pushbots.checkArgsWithAlias(token, platform, alias); err != nil {
+		return nil, err
+	}
+
+	if pushbots.Devices == nil {
+		return nil, ErrNoDeviceStore
+	}
+
+	current, err := pushbots.knownTags(token, platform, alias)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := uniqueStrings(tags)
+	var toAdd, toRemove, unchanged []string
+
+	for _, tag := range wanted {
+		if current.hasEverywhere(tag) {
+			unchanged = append(unchanged, tag)
+		} else {
+			toAdd = append(toAdd, tag)
+		}
+	}
+
+	for _, tag := range current.all() {
+		if !containsString(wanted, tag) {
+			toRemove = append(toRemove, tag)
+		}
+	}
+
+	return pushbots.applyTags(token, platform, alias, toAdd, toRemove, unchanged)
+}
+
+// Tags of the devices addressed by a token or alias, as known by the device store
+type tagSet struct {
+	devices [][]string
+}
+
+func (set *tagSet) hasEverywhere(tag string) bool {
+	if len(set.devices) == 0 {
+		return false
+	}
+
+	for _, tags := range set.devices {
+		if !containsString(tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (set *tagSet) hasAnywhere(tag string) bool {
+	for _, tags := range set.devices {
+		if containsString(tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (set *tagSet) all() []string {
+	var all []string
+
+	for _, tags := range set.devices {
+		for _, tag := range tags {
+			all = addString(all, tag)
+		}
+	}
+
+	sort.Strings(all)
+
+	return all
+}
+
+// Looks up the current tags in the device store, nil if there is no store
+func (pushbots *PushBots) knownTags(token, platform, alias string) (*tagSet, error) {
+	if pushbots.Devices == nil {
+		return nil, nil
+	}
+
+	set := &tagSet{}
+
+	if token != "" {
+		device, err := pushbots.Devices.Get(token)
+
+		if err == nil {
+			set.devices = append(set.devices, device.Tags)
+		} else if err != ErrDeviceNotFound {
+			return nil, err
+		}
+
+		return set, nil
+	}
+
+	devices, err := pushbots.Devices.ByAlias(alias)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		if device.Platform == platform {
+			set.devices = append(set.devices, device.Tags)
+		}
+	}
+
+	return set, nil
+}
+
+// Issues the tag and tag/del calls concurrently, then updates the device store
+// once with every change that succeeded
+func (pushbots *PushBots) applyTags(token, platform, alias string, toAdd, toRemove, unchanged []string) ([]TagResult, error) {
+	results := make([]TagResult, 0, len(toAdd)+len(toRemove)+len(unchanged))
+
+	for _, tag := range toAdd {
+		results = append(results, TagResult{Tag: tag, Operation: TagAdded})
+	}
+
+	for _, tag := range toRemove {
+		results = append(results, TagResult{Tag: tag, Operation: TagRemoved})
+	}
+
+	// The calls themselves must not touch the store concurrently
+	unmirrored := *pushbots
+	unmirrored.Devices = nil
+
+	var wait sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrentTagCalls)
+
+	for i := range results {
+		wait.Add(1)
+		semaphore <- struct{}{}
+
+		go func(result *TagResult) {
+			defer func() {
+				<-semaphore
+				wait.Done()
+			}()
+
+			if result.Operation == TagAdded {
+				result.Err = unmirrored.TagDevice(token, platform, alias, result.Tag)
+			} else {
+				result.Err = unmirrored.UnTagDevice(token, platform, alias, result.Tag)
+			}
+		}(&results[i])
+	}
+
+	wait.Wait()
+
+	for _, tag := range unchanged {
+		results = append(results, TagResult{Tag: tag, Operation: TagUnchanged})
+	}
+
+	tagErrors := make(TagErrors)
+
+	for _, result := range results {
+		if result.Err != nil {
+			tagErrors[result.Tag] = result.Err
+		}
+	}
+
+	pushbots.mirror(token, platform, alias, func(device *Device) {
+		for _, result := range results {
+			if result.Err != nil {
+				continue
+			}
+
+			if result.Operation == TagAdded {
+				device.Tags = addString(device.Tags, result.Tag)
+			} else if result.Operation == TagRemoved {
+				device.Tags = removeString(device.Tags, result.Tag)
+			}
+		}
+	})
+
+	if len(tagErrors) > 0 {
+		return results, tagErrors
+	}
+
+	return results, nil
+}
+
+// Returns values without duplicates or empty strings, keeping the original order
+func uniqueStrings(values []string) []string {
+	var unique []string
+
+	for _, value := range values {
+		if value != "" {
+			unique = addString(unique, value)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,129 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Fails calls for the tag "bad"
+func newTagServer() *recordingServer {
+	return newRespondingServer(func(w http.ResponseWriter, request recordedRequest) {
+		if request.Tag == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+}
+
+// Returns "path tag" for every call received since the last time, sorted
+func takeTagCalls(server *recordingServer) []string {
+	var calls []string
+
+	for _, request := range server.take() {
+		calls = append(calls, request.URL.Path+" "+request.Tag)
+	}
+
+	sort.Strings(calls)
+
+	return calls
+}
+
+func TestBulkTagsWithoutDeviceStore(t *testing.T) {
+	server := newTagServer()
+	defer server.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(server.URL + "/")
+
+	results, err := pushBots.AddTags(token, PlatformIos, "", []string{"a", "b", "a", "bad"})
+
+	tagErrors, ok := err.(TagErrors)
+
+	if !ok || len(tagErrors) != 1 || tagErrors["bad"] == nil {
+		t.Fatal("Expected only the bad tag to fail, got", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatal("Expected one result per unique tag", results)
+	}
+
+	if calls := takeTagCalls(server); !reflect.DeepEqual(calls, []string{"/tag a", "/tag b", "/tag bad"}) {
+		t.Fatal("Wrong calls", calls)
+	}
+
+	if _, err := pushBots.RemoveTags(token, PlatformIos, "", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := takeTagCalls(server); !reflect.DeepEqual(calls, []string{"/tag/del a"}) {
+		t.Fatal("Wrong calls", calls)
+	}
+
+	if _, err := pushBots.SetTags(token, PlatformIos, "", []string{"a"}); err != ErrNoDeviceStore {
+		t.Fatal("Expected ErrNoDeviceStore, got", err)
+	}
+}
+
+func TestBulkTagsWithDeviceStore(t *testing.T) {
+	server := newTagServer()
+	defer server.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(server.URL + "/")
+	pushBots.Devices = NewMemoryDeviceStore()
+	pushBots.Devices.Save(Device{Token: token, Platform: PlatformIos, Tags: []string{"a", "b", "c"}})
+
+	results, err := pushBots.SetTags(token, PlatformIos, "", []string{"b", "c", "d", "e"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := takeTagCalls(server); !reflect.DeepEqual(calls, []string{"/tag d", "/tag e", "/tag/del a"}) {
+		t.Fatal("Only the difference should be sent", calls)
+	}
+
+	operations := make(map[string]string)
+
+	for _, result := range results {
+		operations[result.Tag] = result.Operation
+	}
+
+	expected := map[string]string{"a": TagRemoved, "b": TagUnchanged, "c": TagUnchanged, "d": TagAdded, "e": TagAdded}
+
+	if !reflect.DeepEqual(operations, expected) {
+		t.Fatal("Wrong outcomes", operations)
+	}
+
+	device, _ := pushBots.Devices.Get(token)
+	sort.Strings(device.Tags)
+
+	if !reflect.DeepEqual(device.Tags, []string{"b", "c", "d", "e"}) {
+		t.Fatal("Device store not updated", device.Tags)
+	}
+
+	// Known tags are skipped entirely
+	if _, err := pushBots.AddTags(token, PlatformIos, "", []string{"b", "f"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pushBots.RemoveTags(token, PlatformIos, "", []string{"x", "f"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := takeTagCalls(server); !reflect.DeepEqual(calls, []string{"/tag f", "/tag/del f"}) {
+		t.Fatal("Known state should be skipped", calls)
+	}
+
+	// Failed tags don't end up in the store
+	pushBots.AddTags(token, PlatformIos, "", []string{"bad"})
+
+	if device, _ := pushBots.Devices.Get(token); device.HasTag("bad") {
+		t.Fatal("Failed tag should not be mirrored")
+	}
+}
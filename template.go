@@ -0,0 +1,328 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// NotificationTemplate is a Notification whose Msg, Sound, Badge and string
+// payload values are text/template templates, e.g "Hi {{.Name}}".
+// Templates are parsed once when created and rendered per recipient.
+type NotificationTemplate struct {
+	platform  string
+	msg       *template.Template
+	sound     *template.Template
+	badge     *template.Template
+	payload   map[string]interface{} // Same shape as the original payload, strings replaced by templates
+	variables []string
+}
+
+// TemplateRecipient is a device and the data used to personalize its notification
+type TemplateRecipient struct {
+	Token string
+	Data  map[string]interface{}
+}
+
+// MissingVariablesError is returned when the data for a recipient lacks variables used by a template
+type MissingVariablesError struct {
+	Token     string
+	Variables []string
+}
+
+func (missingErr *MissingVariablesError) Error() string {
+	return fmt.Sprintf("Missing template variables for token %q: %s", missingErr.Token, strings.Join(missingErr.Variables, ", "))
+}
+
+// NewNotificationTemplate compiles every templated field of the notification.
+// Syntax errors are reported here rather than when sending.
+func NewNotificationTemplate(notification Notification) (*NotificationTemplate, error) {
+	var err error
+
+	notificationTemplate := &NotificationTemplate{platform: notification.Platform}
+	variables := make(map[string]bool)
+
+	if notificationTemplate.msg, err = compileTemplate("msg", notification.Msg, variables); err != nil {
+		return nil, err
+	}
+
+	if notificationTemplate.sound, err = compileTemplate("sound", notification.Sound, variables); err != nil {
+		return nil, err
+	}
+
+	if notificationTemplate.badge, err = compileTemplate("badge", notification.Badge, variables); err != nil {
+		return nil, err
+	}
+
+	if notification.Payload != nil {
+		payload, err := compilePayload("payload", notification.Payload, variables)
+
+		if err != nil {
+			return nil, err
+		}
+
+		notificationTemplate.payload = payload.(map[string]interface{})
+	}
+
+	for variable := range variables {
+		notificationTemplate.variables = append(notificationTemplate.variables, variable)
+	}
+
+	sort.Strings(notificationTemplate.variables)
+
+	return notificationTemplate, nil
+}
+
+// Variables returns the sorted names of all top level variables referenced by the template
+func (notificationTemplate *NotificationTemplate) Variables() []string {
+	return append([]string(nil), notificationTemplate.variables...)
+}
+
+// Check returns a *MissingVariablesError if data lacks any variable used by the template
+func (notificationTemplate *NotificationTemplate) Check(token string, data map[string]interface{}) error {
+	var missing []string
+
+	for _, variable := range notificationTemplate.variables {
+		if _, found := data[variable]; !found {
+			missing = append(missing, variable)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &MissingVariablesError{Token: token, Variables: missing}
+	}
+
+	return nil
+}
+
+// Render produces the notification for one recipient
+func (notificationTemplate *NotificationTemplate) Render(data map[string]interface{}) (Notification, error) {
+	var err error
+
+	if err = notificationTemplate.Check("", data); err != nil {
+		return Notification{}, err
+	}
+
+	notification := Notification{Platform: notificationTemplate.platform}
+
+	if notification.Msg, err = executeTemplate(notificationTemplate.msg, data); err != nil {
+		return Notification{}, err
+	}
+
+	if notification.Sound, err = executeTemplate(notificationTemplate.sound, data); err != nil {
+		return Notification{}, err
+	}
+
+	if notification.Badge, err = executeTemplate(notificationTemplate.badge, data); err != nil {
+		return Notification{}, err
+	}
+
+	if notificationTemplate.payload != nil {
+		payload, err := renderPayload(notificationTemplate.payload, data)
+
+		if err != nil {
+			return Notification{}, err
+		}
+
+		notification.Payload = payload.(map[string]interface{})
+	}
+
+	return notification, nil
+}
+
+// Send a personalized push to a single device
+func (pushbots *PushBots) SendTemplatedPush(notificationTemplate *NotificationTemplate, recipient TemplateRecipient) error {
+	err := pushbots.SendTemplatedPushes(notificationTemplate, []TemplateRecipient{recipient})
+
+	if deliveryErrors, ok := err.(DeliveryErrors); ok {
+		return deliveryErrors[recipient.Token]
+	}
+
+	return err
+}
+
+// Send a personalized push to every recipient.
+// All notifications are rendered before the first one is sent, so a missing
+// variable for any recipient means nothing is sent at all. A push that fails
+// doesn't stop the others, failures are returned as DeliveryErrors.
+func (pushbots *PushBots) SendTemplatedPushes(notificationTemplate *NotificationTemplate, recipients []TemplateRecipient) error {
+	notifications := make([]Notification, len(recipients))
+
+	for i, recipient := range recipients {
+		if err := notificationTemplate.Check(recipient.Token, recipient.Data); err != nil {
+			return err
+		}
+
+		notification, err := notificationTemplate.Render(recipient.Data)
+
+		if err != nil {
+			return fmt.Errorf("Could not render notification for token %q: %s", recipient.Token, err)
+		}
+
+		notifications[i] = notification
+	}
+
+	deliveryErrors := make(DeliveryErrors)
+
+	for i, recipient := range recipients {
+		if err := pushbots.SendNotificationToDevice(recipient.Token, notifications[i]); err != nil {
+			deliveryErrors[recipient.Token] = err
+		}
+	}
+
+	if len(deliveryErrors) > 0 {
+		return deliveryErrors
+	}
+
+	return nil
+}
+
+// Parses a single template and records the variables it references
+func compileTemplate(name, text string, variables map[string]bool) (*template.Template, error) {
+	parsed, err := template.New(name).Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collectVariables(parsed.Tree.Root, variables)
+
+	return parsed, nil
+}
+
+// Walks a payload and compiles every string it finds
+func compilePayload(path string, value interface{}, variables map[string]bool) (interface{}, error) {
+	switch typed := value.(type) {
+	case string:
+		return compileTemplate(path, typed, variables)
+	case map[string]interface{}:
+		compiled := make(map[string]interface{}, len(typed))
+
+		for key, nested := range typed {
+			result, err := compilePayload(path+"."+key, nested, variables)
+
+			if err != nil {
+				return nil, err
+			}
+
+			compiled[key] = result
+		}
+
+		return compiled, nil
+	case []interface{}:
+		compiled := make([]interface{}, len(typed))
+
+		for i, nested := range typed {
+			result, err := compilePayload(fmt.Sprintf("%s[%d]", path, i), nested, variables)
+
+			if err != nil {
+				return nil, err
+			}
+
+			compiled[i] = result
+		}
+
+		return compiled, nil
+	default:
+		return value, nil
+	}
+}
+
+// Mirror of compilePayload executing the templates it created
+func renderPayload(value interface{}, data map[string]interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case *template.Template:
+		return executeTemplate(typed, data)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(typed))
+
+		for key, nested := range typed {
+			result, err := renderPayload(nested, data)
+
+			if err != nil {
+				return nil, err
+			}
+
+			rendered[key] = result
+		}
+
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, len(typed))
+
+		for i, nested := range typed {
+			result, err := renderPayload(nested, data)
+
+			if err != nil {
+				return nil, err
+			}
+
+			rendered[i] = result
+		}
+
+		return rendered, nil
+	default:
+		return value, nil
+	}
+}
+
+func executeTemplate(compiled *template.Template, data map[string]interface{}) (string, error) {
+	var buffer bytes.Buffer
+
+	if err := compiled.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// Collects the first identifier of every field reference evaluated against the
+// root data. Bodies of range and with change the meaning of dot and are skipped.
+func collectVariables(node parse.Node, variables map[string]bool) {
+	switch typed := node.(type) {
+	case *parse.ListNode:
+		if typed == nil {
+			return
+		}
+
+		for _, child := range typed.Nodes {
+			collectVariables(child, variables)
+		}
+	case *parse.ActionNode:
+		collectPipeVariables(typed.Pipe, variables)
+	case *parse.IfNode:
+		collectPipeVariables(typed.Pipe, variables)
+		collectVariables(typed.List, variables)
+		collectVariables(typed.ElseList, variables)
+	case *parse.RangeNode:
+		collectPipeVariables(typed.Pipe, variables)
+		collectVariables(typed.ElseList, variables)
+	case *parse.WithNode:
+		collectPipeVariables(typed.Pipe, variables)
+		collectVariables(typed.ElseList, variables)
+	}
+}
+
+func collectPipeVariables(pipe *parse.PipeNode, variables map[string]bool) {
+	if pipe == nil {
+		return
+	}
+
+	for _, command := range pipe.Cmds {
+		for _, arg := range command.Args {
+			switch typed := arg.(type) {
+			case *parse.FieldNode:
+				variables[typed.Ident[0]] = true
+			case *parse.PipeNode:
+				collectPipeVariables(typed, variables)
+			}
+		}
+	}
+}
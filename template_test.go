@@ -0,0 +1,164 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNewNotificationTemplate(t *testing.T) {
+	t.Parallel()
+
+	notificationTemplate, err := NewNotificationTemplate(Notification{
+		Platform: PlatformIos,
+		Msg:      "Hi {{.Name}}, you have {{.Count}} new {{if .Plural}}messages{{else}}message{{end}}",
+		Badge:    "{{.Count}}",
+		Payload:  map[string]interface{}{"user": map[string]interface{}{"id": "{{.UserId}}"}, "static": 1},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Count", "Name", "Plural", "UserId"}
+
+	if !reflect.DeepEqual(notificationTemplate.Variables(), expected) {
+		t.Fatal("Wrong variables", notificationTemplate.Variables())
+	}
+
+	if _, err := NewNotificationTemplate(Notification{Msg: "Hi {{.Name"}); err == nil {
+		t.Fatal("Malformed template should fail to compile")
+	}
+
+	if _, err := NewNotificationTemplate(Notification{Msg: "Hi", Payload: map[string]interface{}{"a": "{{end}}"}}); err == nil {
+		t.Fatal("Malformed payload template should fail to compile")
+	}
+}
+
+func TestRenderNotificationTemplate(t *testing.T) {
+	t.Parallel()
+
+	notificationTemplate, err := NewNotificationTemplate(Notification{
+		Platform: PlatformAndroid,
+		Msg:      "Hi {{.Name}}",
+		Sound:    "ping",
+		Badge:    "{{.Count}}",
+		Payload:  map[string]interface{}{"ids": []interface{}{"{{.Name}}", 2}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notification, err := notificationTemplate.Render(map[string]interface{}{"Name": "Ada", "Count": 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Notification{
+		Platform: PlatformAndroid,
+		Msg:      "Hi Ada",
+		Sound:    "ping",
+		Badge:    "3",
+		Payload:  map[string]interface{}{"ids": []interface{}{"Ada", 2}},
+	}
+
+	if !reflect.DeepEqual(notification, expected) {
+		t.Fatal("Rendered notification was wrong", notification)
+	}
+
+	_, err = notificationTemplate.Render(map[string]interface{}{"Name": "Ada"})
+
+	missingErr, ok := err.(*MissingVariablesError)
+
+	if !ok {
+		t.Fatalf("Expected *MissingVariablesError, got %v", err)
+	}
+
+	if !reflect.DeepEqual(missingErr.Variables, []string{"Count"}) {
+		t.Fatal("Wrong missing variables", missingErr.Variables)
+	}
+}
+
+func TestSendTemplatedPushes(t *testing.T) {
+	server := newRespondingServer(func(w http.ResponseWriter, request recordedRequest) {
+		if request.Token == "broken" {
+			fmt.Fprint(w, "Invalid token")
+		}
+	})
+	defer server.Close()
+
+	// Returns "token:msg" of the pushes that were accepted since the last call
+	takeMessages := func() []string {
+		var messages []string
+
+		for _, request := range server.take() {
+			if request.Token != "broken" {
+				messages = append(messages, request.Token+":"+request.Msg)
+			}
+		}
+
+		return messages
+	}
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(server.URL + "/")
+
+	notificationTemplate, err := NewNotificationTemplate(Notification{Platform: PlatformIos, Msg: "Hi {{.Name}}"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One recipient lacks data, nothing must be sent
+	err = pushBots.SendTemplatedPushes(notificationTemplate, []TemplateRecipient{
+		{Token: "a", Data: map[string]interface{}{"Name": "Ada"}},
+		{Token: "b", Data: map[string]interface{}{}},
+	})
+
+	if missingErr, ok := err.(*MissingVariablesError); !ok || missingErr.Token != "b" {
+		t.Fatalf("Expected missing variables for token b, got %v", err)
+	}
+
+	if messages := takeMessages(); len(messages) != 0 {
+		t.Fatal("Nothing should have been sent", messages)
+	}
+
+	err = pushBots.SendTemplatedPushes(notificationTemplate, []TemplateRecipient{
+		{Token: "a", Data: map[string]interface{}{"Name": "Ada"}},
+		{Token: "b", Data: map[string]interface{}{"Name": "Bob"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := takeMessages(); !reflect.DeepEqual(messages, []string{"a:Hi Ada", "b:Hi Bob"}) {
+		t.Fatal("Wrong messages sent", messages)
+	}
+
+	// A failing push doesn't stop the ones after it
+	err = pushBots.SendTemplatedPushes(notificationTemplate, []TemplateRecipient{
+		{Token: "broken", Data: map[string]interface{}{"Name": "Eve"}},
+		{Token: "a", Data: map[string]interface{}{"Name": "Ada"}},
+	})
+
+	if deliveryErrors, ok := err.(DeliveryErrors); !ok || len(deliveryErrors) != 1 || deliveryErrors["broken"] == nil {
+		t.Fatalf("Expected a delivery error for the broken token, got %v", err)
+	}
+
+	if messages := takeMessages(); !reflect.DeepEqual(messages, []string{"a:Hi Ada"}) {
+		t.Fatal("Push after the failure should be sent", messages)
+	}
+
+	if err := pushBots.SendTemplatedPush(notificationTemplate, TemplateRecipient{Token: "broken",
+		Data: map[string]interface{}{"Name": "Eve"}}); err == nil {
+		t.Fatal("Expected the single push to fail")
+	}
+}
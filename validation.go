@@ -0,0 +1,113 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"fmt"
+)
+
+// Limits used when strictly validating device tokens.
+// APNs tokens are hex encoded and have been 32 bytes long for years,
+// Apple reserves the right to grow them to 100 bytes.
+// FCM registration tokens are opaque but only use an url safe charset.
+const (
+	iosTokenMinLength     = 64
+	iosTokenMaxLength     = 200
+	androidTokenMinLength = 100
+	androidTokenMaxLength = 4096
+)
+
+// ValidationError describes a problem with a single argument passed to the API
+type ValidationError struct {
+	Field   string // Name of the offending argument, e.g "token" or "platform"
+	Value   string // The value that failed validation
+	Message string // Human readable description of the problem
+}
+
+func (validationError *ValidationError) Error() string {
+	return validationError.Message
+}
+
+func newValidationError(field, value, message string) *ValidationError {
+	return &ValidationError{Field: field, Value: value, Message: message}
+}
+
+// ValidateToken checks that a device token is well formed for the given platform.
+// iOS tokens must be an even number of hexadecimal characters (64-200),
+// Android tokens must be 100-4096 characters of [A-Za-z0-9-_:].
+// The returned error is always a *ValidationError.
+func ValidateToken(platform, token string) error {
+	if token == "" {
+		return newValidationError("token", token, "Token needs to be a device token")
+	}
+
+	switch platform {
+	case PlatformIos:
+		if len(token) < iosTokenMinLength || len(token) > iosTokenMaxLength || len(token)%2 != 0 {
+			return newValidationError("token", token,
+				fmt.Sprintf("iOS token must be an even number of hex characters between %d and %d long, got %d",
+					iosTokenMinLength, iosTokenMaxLength, len(token)))
+		}
+
+		for i := 0; i < len(token); i++ {
+			if !isHexChar(token[i]) {
+				return newValidationError("token", token,
+					fmt.Sprintf("iOS token contains non hex character %q at position %d", token[i], i))
+			}
+		}
+	case PlatformAndroid:
+		if len(token) < androidTokenMinLength || len(token) > androidTokenMaxLength {
+			return newValidationError("token", token,
+				fmt.Sprintf("Android token must be between %d and %d characters long, got %d",
+					androidTokenMinLength, androidTokenMaxLength, len(token)))
+		}
+
+		for i := 0; i < len(token); i++ {
+			if !isAndroidTokenChar(token[i]) {
+				return newValidationError("token", token,
+					fmt.Sprintf("Android token contains invalid character %q at position %d", token[i], i))
+			}
+		}
+	default:
+		return newValidationError("platform", platform, "Platform must be either PlatformIos or PlatformAndroid")
+	}
+
+	return nil
+}
+
+func isHexChar(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isAndroidTokenChar(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		c == '-' || c == '_' || c == ':'
+}
+
+// Checks the basic arguments and, if enabled on the client, the token format
+func (pushbots *PushBots) checkArgs(token, platform string) error {
+	if err := checkForArgErrors(token, platform); err != nil {
+		return err
+	}
+
+	if pushbots.StrictTokenValidation {
+		return ValidateToken(platform, token)
+	}
+
+	return nil
+}
+
+// Same as checkArgs but allows the token to be empty when an alias is given
+func (pushbots *PushBots) checkArgsWithAlias(token, platform, alias string) error {
+	if err := checkForArgErrorsWithAlias(token, platform, alias); err != nil {
+		return err
+	}
+
+	if pushbots.StrictTokenValidation && token != "" {
+		return ValidateToken(platform, token)
+	}
+
+	return nil
+}
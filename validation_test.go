@@ -0,0 +1,106 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var (
+	validIosToken     = strings.Repeat("0123456789abcdef", 4)
+	validAndroidToken = "cY2kN3Jz_Q0:APA91b" + strings.Repeat("Hk-7xQ2_abcdEF", 10)
+)
+
+func TestValidateToken(t *testing.T) {
+	t.Parallel()
+
+	if err := ValidateToken(PlatformIos, validIosToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateToken(PlatformIos, strings.ToUpper(validIosToken)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateToken(PlatformAndroid, validAndroidToken); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []struct {
+		platform, token, field string
+	}{
+		{PlatformIos, "", "token"},
+		{PlatformIos, validIosToken[:63], "token"},
+		{PlatformIos, validIosToken[:62], "token"},
+		{PlatformIos, validIosToken[:63] + "g", "token"},
+		{PlatformIos, strings.Repeat("ab", 101), "token"},
+		{PlatformIos, validAndroidToken, "token"},
+		{PlatformAndroid, "short", "token"},
+		{PlatformAndroid, validAndroidToken + "!", "token"},
+		{PlatformAndroid, strings.Repeat("a", 4097), "token"},
+		{PlatformAll, validIosToken, "platform"},
+		{"8", validIosToken, "platform"},
+	}
+
+	for _, c := range invalid {
+		err := ValidateToken(c.platform, c.token)
+
+		if err == nil {
+			t.Fatalf("Expected %q to be rejected for platform %s", c.token, c.platform)
+		}
+
+		validationErr, ok := err.(*ValidationError)
+
+		if !ok {
+			t.Fatalf("Expected a *ValidationError, got %T", err)
+		}
+
+		if validationErr.Field != c.field {
+			t.Fatalf("Expected field %q, got %q", c.field, validationErr.Field)
+		}
+	}
+}
+
+func TestStrictTokenValidation(t *testing.T) {
+	requests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer testServer.Close()
+
+	pushBots := NewPushBots(appId, secret, false)
+	pushBots.ApplyEndpointOverride(testServer.URL + "/")
+
+	// Loose validation lets anything non empty through
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err != nil {
+		t.Fatal(err)
+	}
+
+	pushBots.StrictTokenValidation = true
+
+	if err := pushBots.UnregisterDevice(token, PlatformIos); err == nil {
+		t.Fatal("Malformed token should have been rejected")
+	}
+
+	if err := pushBots.TagDevice(validAndroidToken, PlatformIos, "", tag1); err == nil {
+		t.Fatal("Android token registered as iOS should have been rejected")
+	}
+
+	// Alias only calls have no token to validate
+	if err := pushBots.TagDevice("", PlatformIos, alias, tag1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushBots.UnregisterDevice(validIosToken, PlatformIos); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests to reach the server, got %d", requests)
+	}
+}
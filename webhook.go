@@ -0,0 +1,177 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types received by a WebhookHandler
+const (
+	EventOpened     = "opened"
+	EventDelivered  = "delivered"
+	EventRegistered = "registered"
+)
+
+// Headers used to verify webhook requests
+const (
+	WebhookSecretHeader    = "X-PushBots-Secret"
+	WebhookSignatureHeader = "X-PushBots-Signature"
+)
+
+// Largest request body accepted by a WebhookHandler
+const maxWebhookBodySize = 1 << 20
+
+// Event is a callback from PushBots about a device or notification
+type Event struct {
+	Type     string                 `json:"type"`
+	Token    string                 `json:"token,omitempty"`
+	Platform string                 `json:"platform,omitempty"`
+	Alias    string                 `json:"alias,omitempty"`
+	Payload  map[string]interface{} `json:"payload,omitempty"` // Payload of the notification for opened and delivered
+	Time     time.Time              `json:"time"`
+}
+
+// WebhookHandler is an http.Handler receiving events posted as a JSON object
+// or an array of them. Requests must carry either the shared secret in
+// X-PushBots-Secret or the hex HMAC-SHA256 of the body keyed with it in
+// X-PushBots-Signature, see SignWebhook. Every event is passed to the
+// callbacks registered for its type and then to Events if it is set.
+type WebhookHandler struct {
+	secret   []byte
+	lock     sync.RWMutex
+	handlers map[string][]func(Event)
+	// Optional channel receiving every event, the request waits until it is received
+	Events chan<- Event
+}
+
+// Create a handler accepting requests verified with secret
+func NewWebhookHandler(secret string) *WebhookHandler {
+	return &WebhookHandler{secret: []byte(secret), handlers: make(map[string][]func(Event))}
+}
+
+// On registers a callback for an event type, callbacks run in the request goroutine
+func (webhook *WebhookHandler) On(eventType string, callback func(event Event)) {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+
+	webhook.handlers[eventType] = append(webhook.handlers[eventType], callback)
+}
+
+// SignWebhook returns the X-PushBots-Signature value for body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhook *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize+1))
+
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	} else if len(body) > maxWebhookBodySize {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !webhook.verify(r, body) {
+		http.Error(w, "Invalid secret or signature", http.StatusUnauthorized)
+		return
+	}
+
+	events, err := decodeEvents(body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range events {
+		webhook.dispatch(event)
+
+		if webhook.Events != nil {
+			select {
+			case webhook.Events <- event:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (webhook *WebhookHandler) verify(r *http.Request, body []byte) bool {
+	if len(webhook.secret) == 0 {
+		return false
+	}
+
+	if signature := r.Header.Get(WebhookSignatureHeader); signature != "" {
+		expected := SignWebhook(string(webhook.secret), body)
+		signature = strings.TrimPrefix(strings.ToLower(signature), "sha256=")
+
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(WebhookSecretHeader)), webhook.secret) == 1
+}
+
+func (webhook *WebhookHandler) dispatch(event Event) {
+	webhook.lock.RLock()
+	callbacks := webhook.handlers[event.Type]
+	webhook.lock.RUnlock()
+
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+// Decodes a single event or an array of events, every event needs a type
+func decodeEvents(body []byte) ([]Event, error) {
+	var events []Event
+
+	trimmed := bytes.TrimSpace(body)
+
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &events); err != nil {
+			return nil, err
+		}
+	} else {
+		var event Event
+
+		if err := json.Unmarshal(trimmed, &event); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	for _, event := range events {
+		if event.Type == "" {
+			return nil, newValidationError("type", event.Type, "Event type needs to be set")
+		}
+	}
+
+	return events, nil
+}
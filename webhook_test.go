@@ -0,0 +1,107 @@
+// Copyright 2012 David Pallinder, Fun or die ltd. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pushbots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const webhookSecret = "webhook-secret"
+
+func postWebhook(handler http.Handler, body string, headers map[string]string) int {
+	request := httptest.NewRequest("POST", "/pushbots/events", strings.NewReader(body))
+
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+func TestWebhookVerification(t *testing.T) {
+	webhook := NewWebhookHandler(webhookSecret)
+	body := `{"type":"opened","token":"abc"}`
+
+	tests := []struct {
+		headers  map[string]string
+		expected int
+	}{
+		{nil, http.StatusUnauthorized},
+		{map[string]string{WebhookSecretHeader: "wrong"}, http.StatusUnauthorized},
+		{map[string]string{WebhookSecretHeader: webhookSecret}, http.StatusNoContent},
+		{map[string]string{WebhookSignatureHeader: SignWebhook("wrong", []byte(body))}, http.StatusUnauthorized},
+		{map[string]string{WebhookSignatureHeader: SignWebhook(webhookSecret, []byte(body))}, http.StatusNoContent},
+		{map[string]string{WebhookSignatureHeader: "sha256=" + SignWebhook(webhookSecret, []byte(body))}, http.StatusNoContent},
+		// A bad signature isn't saved by a correct secret
+		{map[string]string{WebhookSignatureHeader: "00", WebhookSecretHeader: webhookSecret}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		if code := postWebhook(webhook, body, test.headers); code != test.expected {
+			t.Fatal("Wrong status for", test.headers, "got", code, "expected", test.expected)
+		}
+	}
+
+	if code := postWebhook(NewWebhookHandler(""), body, map[string]string{WebhookSecretHeader: ""}); code != http.StatusUnauthorized {
+		t.Fatal("Handler without a secret should reject everything", code)
+	}
+}
+
+func TestWebhookDispatch(t *testing.T) {
+	events := make(chan Event, 10)
+	var opened []Event
+
+	webhook := NewWebhookHandler(webhookSecret)
+	webhook.Events = events
+	webhook.On(EventOpened, func(event Event) { opened = append(opened, event) })
+
+	headers := map[string]string{WebhookSecretHeader: webhookSecret}
+	body := `[
+		{"type":"opened","token":"abc","platform":"0","payload":{"campaign":"spring"},"time":"2014-01-01T12:00:00Z"},
+		{"type":"delivered","token":"abc"},
+		{"type":"registered","token":"def","alias":"user-1"}
+	]`
+
+	if code := postWebhook(webhook, body, headers); code != http.StatusNoContent {
+		t.Fatal("Expected events to be accepted", code)
+	}
+
+	if len(opened) != 1 || opened[0].Payload["campaign"] != "spring" || opened[0].Time.Hour() != 12 {
+		t.Fatal("Opened callback not called correctly", opened)
+	}
+
+	close(events)
+	var types []string
+
+	for event := range events {
+		types = append(types, event.Type)
+	}
+
+	if strings.Join(types, ",") != "opened,delivered,registered" {
+		t.Fatal("Wrong events on the channel", types)
+	}
+
+	if code := postWebhook(webhook, `{"token":"abc"}`, headers); code != http.StatusBadRequest {
+		t.Fatal("Event without a type should be rejected", code)
+	}
+
+	if code := postWebhook(webhook, `{"type":`, headers); code != http.StatusBadRequest {
+		t.Fatal("Broken JSON should be rejected", code)
+	}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	recorder := httptest.NewRecorder()
+	webhook.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatal("Only POST should be allowed", recorder.Code)
+	}
+}